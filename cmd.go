@@ -1,90 +1,522 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/pprof"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/config"
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/exposure"
 	"github.com/EP4/kubernetes-ssh-container-exposer/internal/handlers"
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/health"
 	internalLogger "github.com/EP4/kubernetes-ssh-container-exposer/internal/logger"
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/metrics"
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/proxy"
 	"github.com/EP4/kubernetes-ssh-container-exposer/internal/registry"
 	controller "github.com/philipgough/kube-kontroller"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
 )
 
 var logger, _ = zap.NewDevelopment()
 
 const VERSION = "0.2.0"
 
-func newClient(outOfCluster bool) (kubernetes.Interface, error) {
-	if !outOfCluster {
-		config, err := rest.InClusterConfig()
-		if err != nil {
-			return nil, err
+// serviceAccountNamespaceFile is mounted into every pod running under a service account
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// exposureResyncPeriod is how often SSHExposures are checked against their service and private key secret, retrying
+// those which could not be registered
+const exposureResyncPeriod = time.Minute
+
+// newClientConfig for the cluster selected by conf, along with the namespace the controller runs in. The in-cluster
+// config is only used in a pod when no kubeconfig was given, so that the controller also runs from a laptop.
+func newClientConfig(conf config.KubernetesConfig) (*rest.Config, string, error) {
+	if conf.Kubeconfig == "" && conf.Context == "" {
+		restConfig, err := rest.InClusterConfig()
+		if err == nil {
+			namespace, err := podNamespace()
+			return restConfig, namespace, err
 		}
+		if err != rest.ErrNotInCluster {
+			return nil, "", err
+		}
+	}
 
-		return kubernetes.NewForConfig(config)
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = conf.Kubeconfig
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: conf.Context})
+	restConfig, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, "", err
 	}
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		if namespace, _, err = clientConfig.Namespace(); err != nil {
+			return nil, "", err
+		}
+	}
+	return restConfig, namespace, nil
+}
+
+func initializeRegistry(conf config.Config) (registry.Registrable, error) {
+	logger.Info("Registry backend", zap.String("backend", conf.Registry.Backend))
 
-	homeDir := func() string {
-		if h := os.Getenv("HOME"); h != "" {
-			return h
+	switch conf.Registry.Backend {
+	case config.BackendMySQL:
+		r := registry.NewRegistry(logger)
+		if err := r.ConnectDatabase(conf.MySQL); err != nil {
+			return nil, err
+		}
+		return r, nil
+	case config.BackendWorkingDir:
+		r := registry.NewWorkingDir(conf.Registry.WorkingDir, logger)
+		if err := r.Init(); err != nil {
+			return nil, err
 		}
-		return os.Getenv("USERPROFILE") // windows
+		return r, nil
+	case config.BackendEmbedded:
+		return registry.NewMemory(logger), nil
+	default:
+		return nil, fmt.Errorf("unknown registry backend %q", conf.Registry.Backend)
+	}
+}
+
+// podNamespace the controller is running in, preferring the downward API over the service account mount
+func podNamespace() (string, error) {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns, nil
+	}
+	ns, err := ioutil.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(ns)), nil
+}
+
+// watchedNamespaces returns the namespaces to start informers for, where NamespaceAll covers the whole cluster
+func watchedNamespaces(conf config.WatchConfig, ownNamespace string) []string {
+	if conf.OwnNamespace {
+		return []string{ownNamespace}
+	}
+	if len(conf.Namespaces) > 0 {
+		return conf.Namespaces
+	}
+	return []string{metaV1.NamespaceAll}
+}
+
+// runProxy serves the upstreams of the in-memory registry over ssh until stopCh is closed
+func runProxy(r *registry.Memory, conf proxy.Config, stopCh <-chan struct{}) error {
+	hostKey, err := proxy.LoadHostKey(conf.HostKeyFile)
+	if err != nil {
+		return err
+	}
+	if conf.HostKeyFile == "" {
+		logger.Warn("No host key configured, clients will see a new host key on every restart")
 	}
 
-	var kubeconfig *string
-	if home := homeDir(); home != "" {
-		kubeconfig = flag.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
-	} else {
-		kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
+	listener, err := net.Listen("tcp", conf.ListenAddress)
+	if err != nil {
+		return err
+	}
+	logger.Info("Embedded proxy listening", zap.String("address", conf.ListenAddress), zap.String("fingerprint", ssh.FingerprintSHA256(hostKey.PublicKey())))
+
+	go func() {
+		<-stopCh
+		listener.Close()
+	}()
+	go func() {
+		if err := proxy.NewServer(r, hostKey, conf, logger).Serve(listener); err != nil {
+			logger.Info("Embedded proxy stopped", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// runServer serves metrics, the probes of the checker and optionally pprof until stopCh is closed
+func runServer(checker *health.Checker, conf config.ServerConfig, stopCh <-chan struct{}) error {
+	checker.AddLivenessCheck("handlers", func() error {
+		return handlers.CheckWorkers(conf.HandlerTimeout)
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	checker.Install(mux)
+	if conf.Pprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 	}
-	flag.Parse()
 
-	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	listener, err := net.Listen("tcp", conf.Address)
 	if err != nil {
-		panic(err.Error())
+		return err
 	}
+	logger.Info("Serving HTTP", zap.String("address", conf.Address), zap.Bool("pprof", conf.Pprof))
+
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-stopCh
+		server.Close()
+	}()
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			logger.Error("HTTP server stopped", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// runAudit sets the drift gauges by comparing the registry against the cluster until stopCh is closed
+func runAudit(kubeClient kubernetes.Interface, dynamicClient dynamic.Interface, r registry.Registrable, namespaces []string, period time.Duration, stopCh <-chan struct{}) {
+	go wait.Until(func() {
+		if err := handlers.Audit(kubeClient, dynamicClient, r, namespaces, logger); err != nil {
+			logger.Error("Failed to audit registry", zap.Error(err))
+		}
+	}, period, stopCh)
+}
+
+// maxRecoveryBackoff caps the delay between attempts to catch up with the registry
+const maxRecoveryBackoff = 5 * time.Minute
 
-	return kubernetes.NewForConfig(config)
+// runRecovery pings the registry every period until stopCh is closed, and once it answers again after failing runs
+// catchUp for the events the handlers failed on meanwhile, which the controllers only retry a few times. Failed
+// attempts are retried with an exponential backoff, as are those requested through the returned function.
+func runRecovery(r registry.Registrable, period time.Duration, catchUp func() error, stopCh <-chan struct{}) (retry func()) {
+	var pending int32
+	var failures uint
+	var next time.Time
+	go wait.Until(func() {
+		if err := registry.Ping(r); err != nil {
+			if atomic.SwapInt32(&pending, 1) == 0 {
+				logger.Warn("Registry is unreachable", zap.Error(err))
+			}
+			return
+		}
+		if atomic.LoadInt32(&pending) == 0 || time.Now().Before(next) {
+			return
+		}
+		// standbys catch up when they take over
+		if handlers.IsLeading() {
+			logger.Info("Catching up with the registry")
+			if err := catchUp(); err != nil {
+				backoff := period << failures
+				if backoff <= 0 || backoff > maxRecoveryBackoff {
+					backoff = maxRecoveryBackoff
+				} else {
+					failures++
+				}
+				next = time.Now().Add(backoff)
+				logger.Error("Failed to catch up with the registry", zap.Duration("retryIn", backoff), zap.Error(err))
+				return
+			}
+		}
+		atomic.StoreInt32(&pending, 0)
+		failures = 0
+		next = time.Time{}
+	}, period, stopCh)
+	return func() {
+		atomic.StoreInt32(&pending, 1)
+	}
 }
 
-func initializeRegistry() (*registry.Registry, error) {
-	registry := registry.NewRegistry(logger)
-	if err := registry.ConnectDatabase(); err != nil {
+// runLeaderElection campaigns for the lease until stopCh is closed, handing the lease over on the way out before
+// closing the returned channel. The handlers only act while this replica leads, takeOver catches up with what they
+// skipped while standing by before they do. When it fails, retry hands catching up to the registry recovery.
+func runLeaderElection(kubeClient kubernetes.Interface, conf config.LeaderElectionConfig, ownNamespace string, takeOver func() error, retry func(), stopCh <-chan struct{}) (<-chan struct{}, error) {
+	namespace := conf.LeaseNamespace
+	if namespace == "" {
+		namespace = ownNamespace
+	}
+	identity, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := resourcelock.New(resourcelock.LeasesResourceLock, namespace, conf.LeaseName, kubeClient.CoreV1(), kubeClient.CoordinationV1(), resourcelock.ResourceLockConfig{Identity: identity})
+	if err != nil {
 		return nil, err
 	}
-	if err := registry.TruncateAll(); err != nil {
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		Name:            conf.LeaseName,
+		LeaseDuration:   conf.LeaseDuration,
+		RenewDeadline:   conf.RenewDeadline,
+		RetryPeriod:     conf.RetryPeriod,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				logger.Info("Started leading", zap.String("identity", identity))
+				// events wait for the reconciliation, which their writes would race with
+				err := handlers.Pause(func() error {
+					handlers.SetLeading(true)
+					return takeOver()
+				})
+				if err != nil {
+					// exiting would leave the next replica to meet the same fault
+					logger.Error("Failed to take over, retrying", zap.Error(err))
+					retry()
+				}
+			},
+			OnStoppedLeading: func() {
+				handlers.SetLeading(false)
+				select {
+				case <-stopCh:
+					logger.Info("Stopped leading", zap.String("identity", identity))
+				default:
+					// another replica may already be writing, exiting is the only way to be sure this one stops
+					logger.Fatal("lost the lease")
+				}
+			},
+			OnNewLeader: func(leader string) {
+				logger.Info("Leader elected", zap.String("identity", leader))
+			},
+		},
+	})
+	if err != nil {
 		return nil, err
 	}
-	return registry, nil
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+	released := make(chan struct{})
+	go func() {
+		defer close(released)
+		elector.Run(ctx)
+	}()
+	return released, nil
+}
+
+// runControllers starts a secret, a service and an SSHExposure controller for the namespace, along with the exposed
+// secret informer the service handler reads from. The kontroller controllers do not expose whether their caches have
+// synced, so only the informers started here can be waited on.
+func runControllers(kubeClient kubernetes.Interface, dynamicClient dynamic.Interface, r registry.Registrable, recorder record.EventRecorder, conf config.ControllerConfig, namespace string, stopCh <-chan struct{}) cache.InformerSynced {
+	ctrlLogger := internalLogger.NewLogger(logger)
+
+	opts := controller.GetDefaultOptions()
+	opts.Namespace = namespace
+	if conf.ResyncPeriod > 0 {
+		opts.ResyncPeriod = conf.ResyncPeriod
+	}
+	if conf.Workers > 0 {
+		opts.Workers = conf.Workers
+	}
+
+	// only secrets which have opted in are listed and watched
+	secretListOpts := controller.GetDefaultListOpts()
+	secretListOpts.LabelSelector = handlers.ExposeLabelSelector
+
+	exposureHandler := handlers.NewExposureHandler(kubeClient, dynamicClient, r, recorder, logger)
+	exposureInformer := exposure.NewInformer(dynamicClient, namespace, exposureResyncPeriod)
+	exposureCtrl := exposure.NewController(exposureInformer, exposureHandler, opts, logger)
+	// the secret and service handlers sync the exposures routed through them, private key secrets which are not
+	// labelled are only picked up by the exposure resync
+	dependents := exposureHandler.Dependents(exposureInformer.GetIndexer())
+
+	ctrl := controller.NewSecretController(kubeClient, opts, secretListOpts, ctrlLogger)
+	ctrl.SetHandlerFactory(handlers.NewSecretHandler(kubeClient, dependents, r, recorder, logger))
+
+	// the service handler looks secrets up in this cache, the kontroller does not expose its own
+	secretInformer := handlers.NewSecretInformer(kubeClient, namespace, opts.ResyncPeriod)
+	secrets := secretInformer.Informer()
+
+	svcCtrl := controller.NewServiceController(kubeClient, opts, controller.GetDefaultListOpts(), ctrlLogger)
+	svcCtrl.SetHandlerFactory(handlers.NewServiceHandler(kubeClient, secretInformer.Lister(), dependents, r, recorder, logger))
+
+	go ctrl.Run(stopCh)
+	go secrets.Run(stopCh)
+	go svcCtrl.Run(stopCh)
+	go exposureCtrl.Run(stopCh)
+	return func() bool {
+		return secrets.HasSynced() && exposureCtrl.HasSynced()
+	}
 }
 
 func main() {
 	logger.Info("Started", zap.String("version", VERSION))
 	logger.WithOptions()
 
-	registry, err := initializeRegistry()
+	conf, printConfig, err := config.Load(os.Args[0], os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("failed to load config - %v", err.Error()))
+	}
+	if printConfig {
+		out, err := conf.Print()
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("failed to print config - %v", err.Error()))
+		}
+		os.Stdout.Write(out)
+		return
+	}
+
+	backend, err := initializeRegistry(conf)
 	if err != nil {
 		logger.Fatal(fmt.Sprintf("failed to initialize registry - %v", err.Error()))
 	}
+	// serialized outside of the instrumentation so that waiting for the lock is not counted as latency
+	r := registry.Serialize(metrics.InstrumentRegistry(backend))
+
+	// stopCh stops watching and taking new events, drained is closed once the handlers in flight have completed or
+	// been rolled back, and only then are the probes and the lease given up
+	stopCh := make(chan struct{})
+	drained := make(chan struct{})
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		logger.Info("Shutting down", zap.String("signal", sig.String()), zap.Duration("gracePeriod", conf.Shutdown.GracePeriod))
+		close(stopCh)
+		<-signals
+		logger.Fatal("interrupted while shutting down")
+	}()
+
+	// ready once the registry answers and the cluster has been listed, by the startup reconciliation for secrets
+	// and services, or the caches of a standby, and by the informers for SSHExposures
+	var synced []cache.InformerSynced
+	started := make(chan struct{})
+	checker := health.NewChecker()
+	checker.AddReadinessCheck("registry", func() error {
+		return registry.Ping(r)
+	})
+	checker.AddReadinessCheck("sync", func() error {
+		select {
+		case <-started:
+		default:
+			return errors.New("controllers have not started")
+		}
+		for _, hasSynced := range synced {
+			if !hasSynced() {
+				return errors.New("informer caches have not synced")
+			}
+		}
+		return nil
+	})
+	if err = runServer(checker, conf.HTTP, drained); err != nil {
+		logger.Fatal(fmt.Sprintf("failed to start HTTP server - %v", err.Error()))
+	}
+
+	restConfig, ownNamespace, err := newClientConfig(conf.Kubernetes)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("failed to load Kubernetes client config - %v", err.Error()))
+	}
+	logger.Info("Kubernetes API", zap.String("host", restConfig.Host), zap.String("namespace", ownNamespace))
 
-	kubeClient, err := newClient(false)
+	kubeClient, err := kubernetes.NewForConfig(restConfig)
 	if err != nil {
 		logger.Fatal(fmt.Sprintf("failed to create Kubernetes client - %v", err.Error()))
 	}
 
-	ctrlLogger := internalLogger.NewLogger(logger)
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("failed to create Kubernetes dynamic client - %v", err.Error()))
+	}
 
-	ctrl := controller.NewSecretController(kubeClient, controller.GetDefaultOptions(), controller.GetDefaultListOpts(), ctrlLogger)
-	ctrl.SetHandlerFactory(handlers.NewSecretHandler(kubeClient, registry, logger))
+	if err = handlers.SetUsernameTemplate(conf.UsernameTemplate); err != nil {
+		logger.Fatal(fmt.Sprintf("failed to parse username template - %v", err.Error()))
+	}
 
-	stopCh := make(chan struct{})
-	go ctrl.Run(stopCh)
+	namespaces := watchedNamespaces(conf.Watch, ownNamespace)
+
+	recorder := handlers.NewEventRecorder(kubeClient, logger)
+
+	// bring the registry in line with the cluster without dropping upstreams users may be connected through
+	reconcile := func() error {
+		return handlers.Reconcile(kubeClient, dynamicClient, r, namespaces, logger)
+	}
+	if conf.LeaderElection.Enabled {
+		if _, ok := backend.(*registry.Memory); ok {
+			logger.Fatal("leader election is not supported by the embedded backend, each replica serves its own upstreams")
+		}
+		// standbys only fill their caches until they take over
+		handlers.SetLeading(false)
+	} else if err = reconcile(); err != nil {
+		logger.Fatal(fmt.Sprintf("failed to reconcile registry - %v", err.Error()))
+	}
+
+	if memory, ok := backend.(*registry.Memory); ok {
+		if err = runProxy(memory, conf.Proxy, stopCh); err != nil {
+			logger.Fatal(fmt.Sprintf("failed to start embedded proxy - %v", err.Error()))
+		}
+	}
+
+	runAudit(kubeClient, dynamicClient, r, namespaces, conf.Metrics.AuditPeriod, stopCh)
+
+	for _, namespace := range namespaces {
+		logger.Info("Watching namespace", zap.String("namespace", namespace))
+		synced = append(synced, runControllers(kubeClient, dynamicClient, r, recorder, conf.Controller, namespace, stopCh))
+	}
+	close(started)
+
+	// catch up with the events skipped while standing by or failed while the registry was unreachable
+	catchUp := func() error {
+		if err := reconcile(); err != nil {
+			return err
+		}
+		return handlers.CatchUp(kubeClient, r, recorder, namespaces, logger)
+	}
+	retry := runRecovery(r, conf.Registry.RecoveryPeriod, func() error {
+		// events wait for the reconciliation, which their writes would race with
+		return handlers.Pause(catchUp)
+	}, stopCh)
+
+	// closed once the lease is released, which only happens with leader election
+	var released <-chan struct{}
+	if conf.LeaderElection.Enabled {
+		takeOver := func() error {
+			select {
+			case <-stopCh:
+				// the registry may already be closed, the next leader reconciles
+				return nil
+			default:
+			}
+			return catchUp()
+		}
+		if released, err = runLeaderElection(kubeClient, conf.LeaderElection, ownNamespace, takeOver, retry, drained); err != nil {
+			logger.Fatal(fmt.Sprintf("failed to start leader election - %v", err.Error()))
+		}
+	}
 
 	<-stopCh
+	if err = handlers.Drain(conf.Shutdown.GracePeriod); err != nil {
+		logger.Warn("Rolling back registry operations in flight", zap.Error(err))
+	}
+	if err = registry.Close(r); err != nil {
+		logger.Error("failed to close registry", zap.Error(err))
+	}
+	close(drained)
+	if released != nil {
+		<-released
+	}
+	logger.Info("Stopped")
 }
@@ -31,14 +31,64 @@ Create chart name and version as used by the chart label.
 {{- printf "%s-%s" .Chart.Name .Chart.Version | replace "+" "_" | trunc 63 | trimSuffix "-" -}}
 {{- end -}}
 
+{{/*
+Whether the controller is restricted to a set of namespaces and therefore runs under namespaced Roles.
+*/}}
+{{- define "kubernetes-ssh-container-exposer.namespaced" -}}
+{{- if or .Values.watch.ownNamespace .Values.watch.namespaces -}}true{{- end -}}
+{{- end -}}
+
+{{/*
+The namespaces granted a Role, the release namespace when only watching our own.
+*/}}
+{{- define "kubernetes-ssh-container-exposer.watchNamespaces" -}}
+{{- if .Values.watch.ownNamespace -}}
+{{- .Release.Namespace -}}
+{{- else -}}
+{{- join "," .Values.watch.namespaces -}}
+{{- end -}}
+{{- end -}}
+
 {{- define "mysql.service" -}}
 {{- printf "%s_MYSQL_SERVICE" .Release.Name | trunc 63 | trimSuffix "-" | snakecase | upper }}
 {{- end -}}
 
+{{/*
+The MySQL server, the service of the mysql chart when deployed and registry.mysql.host otherwise.
+*/}}
 {{- define "mysql.host" -}}
-{{- template "mysql.service" . -}}_HOST
+{{- if .Values.mysql.enabled -}}
+$({{ template "mysql.service" . }}_HOST)
+{{- else -}}
+{{- required "registry.mysql.host is required when mysql.enabled is false" .Values.registry.mysql.host -}}
+{{- end -}}
 {{- end -}}
 
 {{- define "mysql.port" -}}
-{{- template "mysql.service" . -}}_PORT
-{{- end -}}
\ No newline at end of file
+{{- if .Values.mysql.enabled -}}
+$({{ template "mysql.service" . }}_PORT)
+{{- else -}}
+{{- .Values.registry.mysql.port -}}
+{{- end -}}
+{{- end -}}
+{{/*
+The claim shared by the controller and sshpiper with the workingdir registry backend.
+*/}}
+{{- define "kubernetes-ssh-container-exposer.workingDirClaim" -}}
+{{- default (printf "%s-sshpiper-workingdir" (include "kubernetes-ssh-container-exposer.fullname" .)) .Values.registry.workingDir.existingClaim -}}
+{{- end -}}
+
+{{/*
+The Secret holding the password of the MySQL user, generated by the mysql chart unless given.
+*/}}
+{{- define "kubernetes-ssh-container-exposer.mysqlSecret" -}}
+{{- if .Values.registry.mysql.passwordSecret -}}
+{{- .Values.registry.mysql.passwordSecret -}}
+{{- else if .Values.mysql.fullnameOverride -}}
+{{- .Values.mysql.fullnameOverride | trunc 63 | trimSuffix "-" -}}
+{{- else if contains "mysql" .Release.Name -}}
+{{- .Release.Name | trunc 63 | trimSuffix "-" -}}
+{{- else -}}
+{{- printf "%s-mysql" .Release.Name | trunc 63 | trimSuffix "-" -}}
+{{- end -}}
+{{- end -}}
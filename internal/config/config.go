@@ -0,0 +1,278 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/proxy"
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/registry"
+	"github.com/kelseyhightower/envconfig"
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix of every env var, such as KSCE_REGISTRY_BACKEND for Registry.Backend
+const envPrefix = "KSCE"
+
+// configFileEnv names the config file when the --config flag is not given
+const configFileEnv = "KSCE_CONFIG"
+
+// DefaultUsernameTemplate logs users in with the name of the secret
+const DefaultUsernameTemplate = "{{.Name}}"
+
+// Registry backends selectable with Registry.Backend
+const (
+	BackendMySQL      = "mysql"
+	BackendWorkingDir = "workingdir"
+	// BackendEmbedded keeps upstreams in memory and serves them through the embedded proxy instead of sshpiper
+	BackendEmbedded = "embedded"
+)
+
+// Config of the controller. Defaults are overridden by the YAML config file, then by KSCE_* env vars and last by
+// flags, so that a file can be shared while single values are changed for one run.
+type Config struct {
+	Kubernetes KubernetesConfig `yaml:"kubernetes"`
+	Controller ControllerConfig `yaml:"controller"`
+	Watch      WatchConfig      `yaml:"watch"`
+	// UsernameTemplate renders the default login name of an exposed Secret from its .Namespace and .Name
+	UsernameTemplate string               `yaml:"usernameTemplate" split_words:"true"`
+	Registry         RegistryConfig       `yaml:"registry"`
+	MySQL            registry.Config      `yaml:"mysql" envconfig:"MYSQL"`
+	Proxy            proxy.Config         `yaml:"proxy"`
+	HTTP             ServerConfig         `yaml:"http" envconfig:"HTTP"`
+	Metrics          MetricsConfig        `yaml:"metrics"`
+	Shutdown         ShutdownConfig       `yaml:"shutdown"`
+	LeaderElection   LeaderElectionConfig `yaml:"leaderElection" split_words:"true"`
+}
+
+// KubernetesConfig selects the cluster. The in-cluster config is used when running in a pod without a kubeconfig,
+// otherwise the kubeconfig is loaded like kubectl does, from Kubeconfig, $KUBECONFIG or ~/.kube/config.
+type KubernetesConfig struct {
+	Kubeconfig string `yaml:"kubeconfig"`
+	// Context of the kubeconfig to use instead of its current context
+	Context string `yaml:"context"`
+}
+
+// ControllerConfig of the Secret and Service controllers, where zero values keep the kontroller defaults
+type ControllerConfig struct {
+	ResyncPeriod time.Duration `yaml:"resyncPeriod" split_words:"true"`
+	Workers      int           `yaml:"workers"`
+}
+
+// WatchConfig restricts the controller to a set of namespaces
+type WatchConfig struct {
+	Namespaces []string `yaml:"namespaces"`
+	// OwnNamespace only watches the namespace of the pod, or that of the kubeconfig context out of the cluster, and
+	// takes precedence over Namespaces
+	OwnNamespace bool `yaml:"ownNamespace" split_words:"true"`
+}
+
+// RegistryConfig selects where upstreams are registered for sshpiper
+type RegistryConfig struct {
+	Backend string `yaml:"backend"`
+	// WorkingDir is the root of the volume shared with sshpiper when using the workingdir backend
+	WorkingDir string `yaml:"workingDir" split_words:"true"`
+	// RecoveryPeriod is how often the registry is pinged, catching up with the cluster once it answers again
+	RecoveryPeriod time.Duration `yaml:"recoveryPeriod" split_words:"true"`
+}
+
+// ServerConfig of the HTTP server for metrics, probes and profiling
+type ServerConfig struct {
+	Address string `yaml:"address"`
+	// HandlerTimeout is how long a handler may run before liveness fails, restarting its wedged worker
+	HandlerTimeout time.Duration `yaml:"handlerTimeout" split_words:"true"`
+	// Pprof serves the runtime profiles under /debug/pprof/
+	Pprof bool `yaml:"pprof"`
+}
+
+// MetricsConfig of the audit setting the drift gauges
+type MetricsConfig struct {
+	AuditPeriod time.Duration `yaml:"auditPeriod" split_words:"true"`
+}
+
+// ShutdownConfig bounds how long the controller waits for handlers in flight once signalled to stop. It must leave
+// time before the pod's terminationGracePeriodSeconds to close the registry.
+type ShutdownConfig struct {
+	GracePeriod time.Duration `yaml:"gracePeriod" split_words:"true"`
+}
+
+// LeaderElectionConfig lets replicas stand by and take over through a Lease
+type LeaderElectionConfig struct {
+	Enabled   bool   `yaml:"enabled"`
+	LeaseName string `yaml:"leaseName" split_words:"true"`
+	// LeaseNamespace defaults to the namespace the controller runs in
+	LeaseNamespace string        `yaml:"leaseNamespace" split_words:"true"`
+	LeaseDuration  time.Duration `yaml:"leaseDuration" split_words:"true"`
+	RenewDeadline  time.Duration `yaml:"renewDeadline" split_words:"true"`
+	RetryPeriod    time.Duration `yaml:"retryPeriod" split_words:"true"`
+}
+
+// Default config, which watches the whole cluster and registers upstreams in MySQL
+func Default() Config {
+	return Config{
+		UsernameTemplate: DefaultUsernameTemplate,
+		Registry: RegistryConfig{
+			Backend:        BackendMySQL,
+			WorkingDir:     "/var/sshpiper",
+			RecoveryPeriod: 10 * time.Second,
+		},
+		MySQL: registry.DefaultConfig(),
+		Proxy: proxy.DefaultConfig(),
+		HTTP: ServerConfig{
+			Address:        ":8080",
+			HandlerTimeout: 5 * time.Minute,
+		},
+		Metrics: MetricsConfig{
+			AuditPeriod: time.Minute,
+		},
+		Shutdown: ShutdownConfig{
+			GracePeriod: 25 * time.Second,
+		},
+		LeaderElection: LeaderElectionConfig{
+			LeaseName:     "kubernetes-ssh-container-exposer",
+			LeaseDuration: 15 * time.Second,
+			RenewDeadline: 10 * time.Second,
+			RetryPeriod:   2 * time.Second,
+		},
+	}
+}
+
+// Load the config for the command line args, which also say whether the config should only be printed
+func Load(name string, args []string) (c Config, printConfig bool, err error) {
+	// the flags are parsed once to find the config file, then again over the file and env so that they win
+	var path string
+	if err = newFlagSet(name, &Config{}, &path, &printConfig).Parse(args); err != nil {
+		return c, false, err
+	}
+	if path == "" {
+		path = os.Getenv(configFileEnv)
+	}
+
+	c = Default()
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return c, false, err
+		}
+		if err = yaml.UnmarshalStrict(data, &c); err != nil {
+			return c, false, fmt.Errorf("failed to parse %s - %v", path, err)
+		}
+	}
+	if err = envconfig.Process(envPrefix, &c); err != nil {
+		return c, false, err
+	}
+	if err = newFlagSet(name, &c, &path, &printConfig).Parse(args); err != nil {
+		return c, false, err
+	}
+	return c, printConfig, c.Validate()
+}
+
+// Validate the values which would otherwise only fail once used
+func (c Config) Validate() error {
+	switch c.Registry.Backend {
+	case BackendMySQL, BackendWorkingDir, BackendEmbedded:
+	default:
+		return fmt.Errorf("unknown registry backend %q, expected %s, %s or %s", c.Registry.Backend, BackendMySQL, BackendWorkingDir, BackendEmbedded)
+	}
+	if c.Registry.RecoveryPeriod <= 0 {
+		return fmt.Errorf("registry recovery period must be positive, got %v", c.Registry.RecoveryPeriod)
+	}
+	if c.MySQL.Password != "" && c.MySQL.PasswordFile != "" {
+		return errors.New("only one of the MySQL password and password file can be set")
+	}
+	if c.MySQL.ConnectRetries < 0 {
+		return fmt.Errorf("MySQL connect retries must not be negative, got %d", c.MySQL.ConnectRetries)
+	}
+	if c.Controller.Workers < 0 {
+		return fmt.Errorf("controller workers must not be negative, got %d", c.Controller.Workers)
+	}
+	return nil
+}
+
+// Print the config as YAML, in the format of the config file, without the database password
+func (c Config) Print() ([]byte, error) {
+	if c.MySQL.Password != "" {
+		c.MySQL.Password = "<redacted>"
+	}
+	return yaml.Marshal(c)
+}
+
+func newFlagSet(name string, c *Config, path *string, printConfig *bool) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(path, "config", "", "YAML config file, also read from $"+configFileEnv)
+	fs.BoolVar(printConfig, "print-config", false, "print the effective config and exit")
+
+	fs.StringVar(&c.Kubernetes.Kubeconfig, "kubeconfig", c.Kubernetes.Kubeconfig, "kubeconfig file, the in-cluster config is used in a pod when empty")
+	fs.StringVar(&c.Kubernetes.Context, "context", c.Kubernetes.Context, "kubeconfig context to use instead of the current context")
+
+	fs.DurationVar(&c.Controller.ResyncPeriod, "resync-period", c.Controller.ResyncPeriod, "resync period of the Secret and Service controllers, 0 keeps the kontroller default")
+	fs.IntVar(&c.Controller.Workers, "workers", c.Controller.Workers, "workers of the Secret and Service controllers, 0 keeps the kontroller default")
+
+	fs.Var((*stringList)(&c.Watch.Namespaces), "namespaces", "comma separated namespaces to watch, the whole cluster is watched when empty")
+	fs.BoolVar(&c.Watch.OwnNamespace, "own-namespace", c.Watch.OwnNamespace, "only watch the namespace of the controller")
+	fs.StringVar(&c.UsernameTemplate, "username-template", c.UsernameTemplate, "default login name of an exposed Secret, rendered with its .Namespace and .Name")
+
+	fs.StringVar(&c.Registry.Backend, "registry-backend", c.Registry.Backend, "registry backend, mysql, workingdir or embedded")
+	fs.StringVar(&c.Registry.WorkingDir, "registry-working-dir", c.Registry.WorkingDir, "root of the sshpiper working directory for the workingdir backend")
+	fs.DurationVar(&c.Registry.RecoveryPeriod, "registry-recovery-period", c.Registry.RecoveryPeriod, "how often the registry is pinged, catching up with the cluster once it answers again")
+
+	// the password is left to the env, the config file or a password file so that it does not show in the process list
+	fs.StringVar(&c.MySQL.Host, "mysql-host", c.MySQL.Host, "MySQL host")
+	fs.IntVar(&c.MySQL.Port, "mysql-port", c.MySQL.Port, "MySQL port")
+	fs.StringVar(&c.MySQL.User, "mysql-user", c.MySQL.User, "MySQL user")
+	fs.StringVar(&c.MySQL.PasswordFile, "mysql-password-file", c.MySQL.PasswordFile, "file holding the MySQL password, read again for every new connection")
+	fs.StringVar(&c.MySQL.Database, "mysql-database", c.MySQL.Database, "MySQL database")
+	fs.BoolVar(&c.MySQL.Migrate, "mysql-migrate", c.MySQL.Migrate, "create and migrate the schema on start, otherwise only check its version")
+	fs.BoolVar(&c.MySQL.TLS.Enabled, "mysql-tls", c.MySQL.TLS.Enabled, "connect to MySQL over TLS")
+	fs.StringVar(&c.MySQL.TLS.CAFile, "mysql-tls-ca-file", c.MySQL.TLS.CAFile, "CA verifying the MySQL server certificate, the system roots when empty")
+	fs.StringVar(&c.MySQL.TLS.CertFile, "mysql-tls-cert-file", c.MySQL.TLS.CertFile, "client certificate presented to MySQL")
+	fs.StringVar(&c.MySQL.TLS.KeyFile, "mysql-tls-key-file", c.MySQL.TLS.KeyFile, "key of the client certificate")
+	fs.StringVar(&c.MySQL.TLS.ServerName, "mysql-tls-server-name", c.MySQL.TLS.ServerName, "name in the MySQL server certificate, the host when empty")
+	fs.IntVar(&c.MySQL.ConnectRetries, "mysql-connect-retries", c.MySQL.ConnectRetries, "retries of the startup ping, doubling the backoff after each attempt")
+	fs.DurationVar(&c.MySQL.ConnectBackoff, "mysql-connect-backoff", c.MySQL.ConnectBackoff, "wait before the first retry of the startup ping")
+	fs.IntVar(&c.MySQL.MaxOpenConns, "mysql-max-open-conns", c.MySQL.MaxOpenConns, "maximum open connections, 0 is unlimited")
+	fs.IntVar(&c.MySQL.MaxIdleConns, "mysql-max-idle-conns", c.MySQL.MaxIdleConns, "maximum idle connections")
+	fs.DurationVar(&c.MySQL.ConnMaxLifetime, "mysql-conn-max-lifetime", c.MySQL.ConnMaxLifetime, "how long a connection is reused, 0 is forever")
+	fs.DurationVar(&c.MySQL.QueryTimeout, "mysql-query-timeout", c.MySQL.QueryTimeout, "timeout of each query and registration, 0 is none")
+
+	fs.StringVar(&c.Proxy.ListenAddress, "proxy-listen-address", c.Proxy.ListenAddress, "address the embedded proxy listens on")
+	fs.StringVar(&c.Proxy.HostKeyFile, "proxy-host-key-file", c.Proxy.HostKeyFile, "host key of the embedded proxy, generated on every start when empty")
+	fs.DurationVar(&c.Proxy.DialTimeout, "proxy-dial-timeout", c.Proxy.DialTimeout, "timeout of the embedded proxy connecting to upstreams")
+	fs.BoolVar(&c.Proxy.InsecureIgnoreHostKeys, "proxy-insecure-ignore-host-keys", c.Proxy.InsecureIgnoreHostKeys, "connect to upstreams without pinned host keys without verifying them")
+
+	fs.StringVar(&c.HTTP.Address, "http-address", c.HTTP.Address, "address serving metrics and probes")
+	fs.DurationVar(&c.HTTP.HandlerTimeout, "http-handler-timeout", c.HTTP.HandlerTimeout, "how long a handler may run before liveness fails")
+	fs.BoolVar(&c.HTTP.Pprof, "http-pprof", c.HTTP.Pprof, "serve the runtime profiles under /debug/pprof/")
+
+	fs.DurationVar(&c.Metrics.AuditPeriod, "metrics-audit-period", c.Metrics.AuditPeriod, "how often the registry is compared against the cluster")
+	fs.DurationVar(&c.Shutdown.GracePeriod, "shutdown-grace-period", c.Shutdown.GracePeriod, "how long handlers in flight may complete on shutdown")
+
+	fs.BoolVar(&c.LeaderElection.Enabled, "leader-election", c.LeaderElection.Enabled, "only act on events while holding the lease")
+	fs.StringVar(&c.LeaderElection.LeaseName, "leader-election-lease-name", c.LeaderElection.LeaseName, "name of the lease")
+	fs.StringVar(&c.LeaderElection.LeaseNamespace, "leader-election-lease-namespace", c.LeaderElection.LeaseNamespace, "namespace of the lease, the namespace of the controller when empty")
+	fs.DurationVar(&c.LeaderElection.LeaseDuration, "leader-election-lease-duration", c.LeaderElection.LeaseDuration, "how long standbys wait before taking over a lease which is not renewed")
+	fs.DurationVar(&c.LeaderElection.RenewDeadline, "leader-election-renew-deadline", c.LeaderElection.RenewDeadline, "how long the leader retries renewing before giving up the lease")
+	fs.DurationVar(&c.LeaderElection.RetryPeriod, "leader-election-retry-period", c.LeaderElection.RetryPeriod, "interval between attempts to acquire or renew the lease")
+	return fs
+}
+
+// stringList is a comma separated flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
+}
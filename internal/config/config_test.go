@@ -0,0 +1,110 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	f, err := ioutil.TempFile("", "ksce-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+registry:
+  backend: workingdir
+mysql:
+  host: file
+metrics:
+  auditPeriod: 5m
+`)
+	defer os.Remove(path)
+
+	os.Setenv("KSCE_MYSQL_HOST", "env")
+	os.Setenv("KSCE_METRICS_AUDIT_PERIOD", "2m")
+	defer os.Unsetenv("KSCE_MYSQL_HOST")
+	defer os.Unsetenv("KSCE_METRICS_AUDIT_PERIOD")
+
+	c, printConfig, err := Load("ksce", []string{"--config", path, "--metrics-audit-period", "30s", "--namespaces", "a, b"})
+	if err != nil {
+		t.Fatalf("unexpected error - %v", err)
+	}
+	if printConfig {
+		t.Errorf("expected the config not to be printed")
+	}
+
+	if c.Registry.Backend != BackendWorkingDir {
+		t.Errorf("expected the backend from the file - got %q", c.Registry.Backend)
+	}
+	if c.MySQL.Host != "env" {
+		t.Errorf("expected the env to override the file - got host %q", c.MySQL.Host)
+	}
+	if c.Metrics.AuditPeriod != 30*time.Second {
+		t.Errorf("expected the flag to override the env - got audit period %v", c.Metrics.AuditPeriod)
+	}
+	if !reflect.DeepEqual(c.Watch.Namespaces, []string{"a", "b"}) {
+		t.Errorf("expected namespaces [a b] - got %v", c.Watch.Namespaces)
+	}
+	if c.HTTP.Address != Default().HTTP.Address || c.MySQL.Port != Default().MySQL.Port {
+		t.Errorf("expected unset values to keep their defaults - got %+v", c)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		args []string
+	}{
+		{name: "unknown key", file: "registry:\n  backnd: mysql\n"},
+		{name: "unknown backend", args: []string{"--registry-backend", "postgres"}},
+		{name: "negative workers", args: []string{"--workers", "-1"}},
+		{name: "password and password file", file: "mysql:\n  password: secret\n", args: []string{"--mysql-password-file", "/etc/ksce/mysql/password"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				path := writeConfigFile(t, tt.file)
+				defer os.Remove(path)
+				args = append([]string{"--config", path}, args...)
+			}
+			if _, _, err := Load("ksce", args); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestPrint(t *testing.T) {
+	c := Default()
+	c.MySQL.Password = "secret"
+
+	out, err := c.Print()
+	if err != nil {
+		t.Fatalf("unexpected error - %v", err)
+	}
+	if strings.Contains(string(out), "secret") {
+		t.Errorf("expected the password to be redacted - got\n%s", out)
+	}
+	if !strings.Contains(string(out), "auditPeriod: 1m0s") {
+		t.Errorf("expected the config file format - got\n%s", out)
+	}
+	if c.MySQL.Password != "secret" {
+		t.Errorf("expected printing to leave the config unchanged")
+	}
+}
@@ -0,0 +1,145 @@
+package exposure
+
+import (
+	"time"
+
+	controller "github.com/philipgough/kube-kontroller"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// Used when the options leave them unset
+const (
+	defaultWorkers    = 1
+	defaultMaxRetries = 5
+)
+
+// Controller queues the keys of SSHExposures notified by the informer and hands the current state of each to the
+// handlers of the factory, retrying failures with a rate limited backoff as the secret and service controllers do.
+// Queueing keys rather than events means an exposure is never handled by two workers at once, and a retry always
+// sees its latest spec.
+type Controller struct {
+	informer   cache.SharedIndexInformer
+	queue      workqueue.RateLimitingInterface
+	handlers   controller.HandlerFactory
+	workers    int
+	maxRetries int
+	logger     *zap.Logger
+}
+
+// NewController handles the exposures of the informer with the workers and retries of the options
+func NewController(informer cache.SharedIndexInformer, f controller.HandlerFactory, opts controller.Options, l *zap.Logger) *Controller {
+	c := &Controller{
+		informer:   informer,
+		queue:      workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), GroupVersionResource.Resource),
+		handlers:   f,
+		workers:    opts.Workers,
+		maxRetries: opts.MaxRetries,
+		logger:     l,
+	}
+	if c.workers <= 0 {
+		c.workers = defaultWorkers
+	}
+	if c.maxRetries <= 0 {
+		c.maxRetries = defaultMaxRetries
+	}
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueue,
+		UpdateFunc: func(_, new interface{}) {
+			c.enqueue(new)
+		},
+		// tombstones of deletes missed while the watch was down are keyed by the object they hold
+		DeleteFunc: c.enqueue,
+	})
+	return c
+}
+
+// Run starts the workers once the cache has synced and blocks until stopCh is closed
+func (c *Controller) Run(stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer c.queue.ShutDown()
+
+	go c.informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, c.informer.HasSynced) {
+		return
+	}
+	for i := 0; i < c.workers; i++ {
+		go wait.Until(c.runWorker, time.Second, stopCh)
+	}
+	<-stopCh
+}
+
+// HasSynced reports whether the cache of the informer has synced
+func (c *Controller) HasSynced() bool {
+	return c.informer.HasSynced()
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		c.logger.Error("failed to queue SSHExposure", zap.Error(err))
+		return
+	}
+	c.queue.Add(key)
+}
+
+func (c *Controller) runWorker() {
+	for c.processNextItem() {
+	}
+}
+
+func (c *Controller) processNextItem() bool {
+	item, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(item)
+
+	key := item.(string)
+	err := c.handle(key)
+	switch {
+	case err == nil:
+		c.queue.Forget(item)
+	case c.queue.NumRequeues(item) < c.maxRetries:
+		c.logger.Warn("failed to handle SSHExposure, retrying", zap.String("key", key), zap.Error(err))
+		c.queue.AddRateLimited(item)
+	default:
+		// the next resync of the informer queues the exposure again
+		c.logger.Error("failed to handle SSHExposure, giving up", zap.String("key", key), zap.Error(err))
+		c.queue.Forget(item)
+	}
+	return true
+}
+
+// handle the current state of the exposure. Exposures still cached are handled as an update to themselves, which
+// leaves those already registered as their current generation alone, and deleted ones are only known by their key.
+func (c *Controller) handle(key string) error {
+	obj, exists, err := c.informer.GetIndexer().GetByKey(key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		// cached objects are shared with the informer
+		obj = obj.(*unstructured.Unstructured).DeepCopy()
+		h := c.handlers.NewUpdateHandler()
+		h.SetObjects(obj, obj)
+		return h.Handle()
+	}
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	deleted := &unstructured.Unstructured{}
+	deleted.SetGroupVersionKind(GroupVersionResource.GroupVersion().WithKind(Kind))
+	deleted.SetNamespace(namespace)
+	deleted.SetName(name)
+	h := c.handlers.NewDeleteHandler()
+	h.SetObject(deleted)
+	return h.Handle()
+}
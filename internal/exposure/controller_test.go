@@ -0,0 +1,109 @@
+package exposure
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	controller "github.com/philipgough/kube-kontroller"
+	"go.uber.org/zap"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicFake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestControllerRetriesAndDeletes(t *testing.T) {
+	l, _ := zap.NewDevelopment()
+	object := &unstructured.Unstructured{}
+	object.SetGroupVersionKind(GroupVersionResource.GroupVersion().WithKind(Kind))
+	object.SetNamespace("alice")
+	object.SetName("exposure")
+
+	scheme := runtime.NewScheme()
+	scheme.AddKnownTypeWithName(schema.GroupVersionKind{Group: "fake-dynamic-client-group", Version: "v1", Kind: "List"}, &unstructured.UnstructuredList{})
+	client := dynamicFake.NewSimpleDynamicClient(scheme, object)
+
+	f := &recordingFactory{failures: 2, handled: make(chan string, 10)}
+	c := NewController(NewInformer(client, "alice", 0), f, controller.Options{MaxRetries: 3}, l)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go c.Run(stopCh)
+
+	// failures are retried until the handler succeeds
+	for _, expect := range []string{"update", "update", "update"} {
+		if got := receive(t, f.handled); got != expect {
+			t.Fatalf("expected %s - got %s", expect, got)
+		}
+	}
+
+	if err := client.Resource(GroupVersionResource).Namespace("alice").Delete("exposure", &metaV1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete exposure - %v", err)
+	}
+	if got := receive(t, f.handled); got != "delete alice/exposure" {
+		t.Errorf("expected the delete to be handled by key - got %s", got)
+	}
+}
+
+func receive(t *testing.T, handled <-chan string) string {
+	t.Helper()
+	select {
+	case h := <-handled:
+		return h
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the controller")
+		return ""
+	}
+}
+
+// recordingFactory fails the first updates, sending what each handler was called for
+type recordingFactory struct {
+	mu       sync.Mutex
+	failures int
+	handled  chan string
+}
+
+type recordingHandler struct {
+	f    *recordingFactory
+	kind string
+	obj  interface{}
+}
+
+func (f *recordingFactory) NewCreateHandler() controller.HandleCreate {
+	return &recordingHandler{f: f, kind: "create"}
+}
+
+func (f *recordingFactory) NewUpdateHandler() controller.HandleUpdate {
+	return &recordingHandler{f: f, kind: "update"}
+}
+
+func (f *recordingFactory) NewDeleteHandler() controller.HandleDelete {
+	return &recordingHandler{f: f, kind: "delete"}
+}
+
+func (h *recordingHandler) SetObject(obj interface{}) {
+	h.obj = obj
+}
+
+func (h *recordingHandler) SetObjects(_, new interface{}) {
+	h.obj = new
+}
+
+func (h *recordingHandler) Handle() error {
+	if h.kind == "delete" {
+		u := h.obj.(*unstructured.Unstructured)
+		h.f.handled <- h.kind + " " + u.GetNamespace() + "/" + u.GetName()
+		return nil
+	}
+	h.f.handled <- h.kind
+
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+	if h.f.failures > 0 {
+		h.f.failures--
+		return errors.New("transient")
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package exposure
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ServiceIndex and SecretIndex look exposures up by the IndexKey of the service and private key secret they refer
+// to, so that changes to either can be followed up on the exposures
+const (
+	ServiceIndex = "service"
+	SecretIndex  = "secret"
+)
+
+// Indexers of the informer cache
+var Indexers = cache.Indexers{
+	cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+	ServiceIndex:         indexBy("spec", "serviceName"),
+	SecretIndex:          indexBy("spec", "privateKeySecretRef", "name"),
+}
+
+// NewInformer lists and watches SSHExposures in the namespace, where NamespaceAll covers the whole cluster.
+// Every resync delivers an update, which is what retries exposures that could not be registered and picks up
+// changes to the services and secrets they refer to.
+func NewInformer(client dynamic.Interface, namespace string, resync time.Duration) cache.SharedIndexInformer {
+	return dynamicinformer.NewFilteredDynamicInformer(client, GroupVersionResource, namespace, resync, Indexers, nil).Informer()
+}
+
+// IndexKey of a service or secret in the namespace
+func IndexKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// indexBy the object named by the field of the spec, in the namespace of the exposure
+func indexBy(fields ...string) cache.IndexFunc {
+	return func(obj interface{}) ([]string, error) {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return nil, fmt.Errorf("unexpected type %T for %s", obj, Kind)
+		}
+		name, _, err := unstructured.NestedString(u.Object, fields...)
+		if err != nil || name == "" {
+			return nil, err
+		}
+		return []string{IndexKey(u.GetNamespace(), name)}, nil
+	}
+}
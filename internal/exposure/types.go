@@ -0,0 +1,97 @@
+package exposure
+
+import (
+	"fmt"
+
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	Group   = "ksce.io"
+	Version = "v1alpha1"
+	Kind    = "SSHExposure"
+)
+
+// DefaultPrivateKeyKey is read from the referenced secret when the key is not set, falling back to sshpiper_id_rsa
+const DefaultPrivateKeyKey = "sshpiper_private_key"
+
+// GroupVersionResource of the SSHExposure custom resource, served by the CRD in the helm chart
+var GroupVersionResource = schema.GroupVersionResource{Group: Group, Version: Version, Resource: "sshexposures"}
+
+type (
+	// SSHExposure exposes the ssh port of a service through sshpiper
+	SSHExposure struct {
+		metaV1.TypeMeta   `json:",inline"`
+		metaV1.ObjectMeta `json:"metadata,omitempty"`
+
+		Spec   Spec   `json:"spec"`
+		Status Status `json:"status,omitempty"`
+	}
+
+	Spec struct {
+		// ServiceName in the namespace of the exposure sshpiper routes to
+		ServiceName string `json:"serviceName"`
+		// Port of the service by name or number, selected as for secrets when empty
+		Port string `json:"port,omitempty"`
+		// Username users log in with, ssh -l {Username}
+		Username string `json:"username,omitempty"`
+		// UpstreamUsername sshpiper logs in to the container as
+		UpstreamUsername string `json:"upstreamUsername,omitempty"`
+		// AuthorizedKeys allowed to log in, in authorized_keys format
+		AuthorizedKeys []string `json:"authorizedKeys,omitempty"`
+		// TrustedUserCAKeys sign the user certificates allowed to log in for one of the Principals
+		TrustedUserCAKeys []string `json:"trustedUserCAKeys,omitempty"`
+		// Principals accepted in user certificates, defaulting to the username
+		Principals []string `json:"principals,omitempty"`
+		// UpstreamHostKeys the container may present, in authorized_keys format. Only the embedded proxy verifies them.
+		UpstreamHostKeys []string `json:"upstreamHostKeys,omitempty"`
+		// PrivateKeySecretRef holds the key sshpiper logs in to the container with
+		PrivateKeySecretRef SecretKeyRef `json:"privateKeySecretRef"`
+	}
+
+	SecretKeyRef struct {
+		Name string `json:"name"`
+		Key  string `json:"key,omitempty"`
+	}
+
+	Status struct {
+		// ObservedGeneration is the generation of the spec last reconciled
+		ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+		// Registered is true when the exposure is routable through sshpiper
+		Registered bool `json:"registered"`
+		// Reason matches the reason of the last event recorded against the exposure
+		Reason  string `json:"reason,omitempty"`
+		Message string `json:"message,omitempty"`
+		// Username and Address the exposure is registered with
+		Username   string       `json:"username,omitempty"`
+		Address    string       `json:"address,omitempty"`
+		LastSynced *metaV1.Time `json:"lastSynced,omitempty"`
+		// UpstreamChecksum of the registered upstream, which resyncs compare to spot changes to the service and
+		// secret
+		UpstreamChecksum string `json:"upstreamChecksum,omitempty"`
+	}
+)
+
+// FromUnstructured converts an object served by the dynamic client
+func FromUnstructured(object interface{}) (*SSHExposure, error) {
+	u, ok := object.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected type %T for %s", object, Kind)
+	}
+	e := &SSHExposure{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// PrivateKeyKey of the referenced secret holding the private key
+func (s Spec) PrivateKeyKey() string {
+	if s.PrivateKeySecretRef.Key == "" {
+		return DefaultPrivateKeyKey
+	}
+	return s.PrivateKeySecretRef.Key
+}
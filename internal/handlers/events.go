@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/registry"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedCoreV1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// EventComponent is reported as the source of the events emitted by the handlers
+const EventComponent = "kubernetes-ssh-container-exposer"
+
+// Reasons of the events recorded against secrets, services and exposures, surfaced by kubectl describe
+const (
+	ReasonRegistered              = "Registered"
+	ReasonUnregistered            = "Unregistered"
+	ReasonKeyGenerated            = "KeyGenerated"
+	ReasonInvalidPublicKey        = "InvalidPublicKey"
+	ReasonInvalidPrivateKey       = "InvalidPrivateKey"
+	ReasonKeyMismatch             = "KeyMismatch"
+	ReasonInvalidSecret           = "InvalidSecret"
+	ReasonInvalidExposure         = "InvalidExposure"
+	ReasonServiceNotFound         = "ServiceNotFound"
+	ReasonUsernameTaken           = "UsernameTaken"
+	ReasonCertificatesUnsupported = "CertificatesUnsupported"
+	ReasonDatabaseError           = "DatabaseError"
+)
+
+// LastSyncedAnnotation and RegisteredUsernameAnnotation record the outcome of the last successful registration
+// on the secret
+const (
+	LastSyncedAnnotation         = "ksce.io/last-synced"
+	RegisteredUsernameAnnotation = "ksce.io/registered-username"
+)
+
+// statusAnnotations are written by the handlers and so are ignored when deciding whether a secret has changed
+var statusAnnotations = []string{LastSyncedAnnotation, RegisteredUsernameAnnotation}
+
+// syncError carries the event reason describing why a secret could not be registered
+type syncError struct {
+	reason string
+	err    error
+}
+
+func (e syncError) Error() string {
+	return e.err.Error()
+}
+
+// NewEventRecorder records events through the API server on behalf of the handlers
+func NewEventRecorder(c kubernetes.Interface, l *zap.Logger) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(l.Sugar().Debugf)
+	broadcaster.StartRecordingToSink(&typedCoreV1.EventSinkImpl{Interface: c.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: EventComponent})
+}
+
+// syncSecret registers the upstream for the secret and its service, recording the outcome as events and
+// annotations. Events left unregistered for good are returned as skipped, any other error is worth retrying.
+func syncSecret(secret *v1.Secret, service *v1.Service, client kubernetes.Interface, r registry.Registrable, recorder record.EventRecorder, l *zap.Logger) error {
+	keyed, err := ensureSSHPiperKey(secret, client, recorder, l)
+	var u *registry.Upstream
+	if err == nil {
+		secret = keyed
+		u, err = getUpstreamFromSecret(secret)
+	}
+	if err == nil {
+		err = checkPublicKeySecret(secret.Namespace, secret.Name, []byte(u.SSHPiperPrivateKey), client)
+	}
+	if err != nil {
+		se, ok := err.(syncError)
+		if !ok {
+			// transient api errors, including conflicts with another handler generating the key, are worth retrying
+			return err
+		}
+		l.Sugar().Errorf("failed to parse secret %s/%s - %v", secret.Namespace, secret.Name, err)
+		recorder.Event(secret, v1.EventTypeWarning, se.reason, err.Error())
+		return skipped(se.reason)
+	}
+
+	u.Address = sshAddress(service)
+	_, err = r.RegisterUpstream(u)
+	switch err {
+	case nil:
+	case registry.ErrUsernameTaken:
+		// retrying will not help until one of the conflicting secrets changes
+		l.Error("username is already in use", zap.String("name", u.Name), zap.String("username", u.Username))
+		recorder.Eventf(secret, v1.EventTypeWarning, ReasonUsernameTaken, "username %s is already registered to another upstream", u.Username)
+		return skipped(ReasonUsernameTaken)
+	default:
+		// potentially a transient error so retries within the limits are worth doing
+		recorder.Eventf(secret, v1.EventTypeWarning, ReasonDatabaseError, "failed to register upstream - %v", err)
+		return err
+	}
+
+	recorder.Eventf(secret, v1.EventTypeNormal, ReasonRegistered, "registered as %s for %s", u.Username, u.Address)
+	warnUnverifiedCertificates(secret, u, r, recorder)
+	recorder.Eventf(service, v1.EventTypeNormal, ReasonRegistered, "registered as %s", u.Username)
+	if err = annotateSynced(client, secret, u.Username); err != nil {
+		// the registration itself succeeded so this is not worth retrying
+		l.Sugar().Errorf("failed to annotate secret %s/%s - %v", secret.Namespace, secret.Name, err)
+	}
+	return nil
+}
+
+// warnUnverifiedCertificates when the upstream trusts user CAs the backend cannot enforce, in which case only the
+// listed public keys are accepted at login
+func warnUnverifiedCertificates(object runtime.Object, u *registry.Upstream, r registry.Registrable, recorder record.EventRecorder) {
+	if len(u.TrustedUserCAKeys) == 0 || registry.VerifiesCertificates(r) {
+		return
+	}
+	recorder.Event(object, v1.EventTypeWarning, ReasonCertificatesUnsupported,
+		"the registry backend cannot verify user certificates, only the listed public keys are accepted")
+}
+
+// annotateSynced records the time and username of the last successful registration on the secret
+func annotateSynced(client kubernetes.Interface, secret *v1.Secret, username string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				LastSyncedAnnotation:         time.Now().UTC().Format(time.RFC3339),
+				RegisteredUsernameAnnotation: username,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.CoreV1().Secrets(secret.Namespace).Patch(secret.Name, types.MergePatchType, patch)
+	return err
+}
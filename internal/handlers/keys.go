@@ -0,0 +1,233 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+// Data keys of the exposed secret and of the companion secret mounted into the container. Keys may be RSA, ECDSA
+// or ed25519.
+const (
+	SSHPiperPrivateKeyKey  = "sshpiper_private_key"
+	DownstreamPublicKeyKey = "downstream_authorized_keys"
+	AuthorizedKeysKey      = "authorized_keys"
+	TrustedUserCAKeysKey   = "trusted_user_ca_keys"
+	UpstreamHostKeysKey    = "upstream_host_keys"
+)
+
+// LegacySSHPiperPrivateKeyKey and LegacyDownstreamPublicKeyKey are still read from secrets which predate the
+// algorithm neutral names
+const (
+	LegacySSHPiperPrivateKeyKey  = "sshpiper_id_rsa"
+	LegacyDownstreamPublicKeyKey = "downstream_id_rsa.pub"
+)
+
+// PublicKeySecretSuffix names the companion secret holding the authorized_keys for sshpiper, <name>-sshpiper-publickey
+const PublicKeySecretSuffix = "-sshpiper-publickey"
+
+// GeneratedKeyAnnotation marks secrets whose sshpiper key was generated by the controller, whose companion secret
+// is therefore maintained by the controller too
+const GeneratedKeyAnnotation = "ksce.io/sshpiper-key-generated"
+
+// opensshKeyMagic starts the body of keys in the OpenSSH format, followed by the name of the cipher
+const opensshKeyMagic = "openssh-key-v1\x00"
+
+// generatedKeyBits is the size of the generated sshpiper RSA keys
+const generatedKeyBits = 2048
+
+// secretData reads the data key, falling back to its legacy name
+func secretData(secret *v1.Secret, key, legacy string) []byte {
+	if data := secret.Data[key]; len(data) > 0 {
+		return data
+	}
+	return secret.Data[legacy]
+}
+
+// sshPiperKey of the exposed secret
+func sshPiperKey(secret *v1.Secret) []byte {
+	return secretData(secret, SSHPiperPrivateKeyKey, LegacySSHPiperPrivateKeyKey)
+}
+
+// publicKeySecretName of the companion secret for the exposed secret
+func publicKeySecretName(name string) string {
+	return name + PublicKeySecretSuffix
+}
+
+// ensureSSHPiperKey generates the sshpiper key when the secret omits it and keeps the companion authorized_keys
+// secret of generated keys up to date. The secret holding the key is returned.
+func ensureSSHPiperKey(secret *v1.Secret, client kubernetes.Interface, rec record.EventRecorder, l *zap.Logger) (*v1.Secret, error) {
+	if len(sshPiperKey(secret)) == 0 {
+		privateKey, err := generateSSHPiperKey()
+		if err != nil {
+			return nil, err
+		}
+
+		updated := secret.DeepCopy()
+		if updated.Data == nil {
+			updated.Data = make(map[string][]byte)
+		}
+		if updated.Annotations == nil {
+			updated.Annotations = make(map[string]string)
+		}
+		updated.Data[SSHPiperPrivateKeyKey] = privateKey
+		updated.Annotations[GeneratedKeyAnnotation] = "true"
+
+		// updating rather than patching fails on a conflict, so handlers racing on the same secret never store two keys
+		if secret, err = client.CoreV1().Secrets(secret.Namespace).Update(updated); err != nil {
+			return nil, err
+		}
+		l.Info("Generated sshpiper key", zap.String("name", secret.Name), zap.String("namespace", secret.Namespace))
+		rec.Eventf(secret, v1.EventTypeNormal, ReasonKeyGenerated, "generated the sshpiper key, mount %s into the container", publicKeySecretName(secret.Name))
+	}
+
+	if secret.Annotations[GeneratedKeyAnnotation] != "true" {
+		// the companion secret of a key supplied by the user is the user's to maintain
+		return secret, nil
+	}
+	return secret, ensurePublicKeySecret(secret, client)
+}
+
+// ensurePublicKeySecret creates or updates the companion secret with the public half of the sshpiper key. The
+// companion is owned by the exposed secret so that it is garbage collected along with it.
+func ensurePublicKeySecret(secret *v1.Secret, client kubernetes.Interface) error {
+	signer, err := parseSSHPiperKey(sshPiperKey(secret))
+	if err != nil {
+		return err
+	}
+	authorizedKey := ssh.MarshalAuthorizedKey(signer.PublicKey())
+
+	name := publicKeySecretName(secret.Name)
+	existing, err := client.CoreV1().Secrets(secret.Namespace).Get(name, metaV1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = client.CoreV1().Secrets(secret.Namespace).Create(&v1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{
+				Name:      name,
+				Namespace: secret.Namespace,
+				OwnerReferences: []metaV1.OwnerReference{
+					*metaV1.NewControllerRef(secret, v1.SchemeGroupVersion.WithKind("Secret")),
+				},
+			},
+			Type: v1.SecretTypeOpaque,
+			Data: map[string][]byte{AuthorizedKeysKey: authorizedKey},
+		})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if !metaV1.IsControlledBy(existing, secret) || bytes.Equal(existing.Data[AuthorizedKeysKey], authorizedKey) {
+		// secrets created by the user are left alone
+		return nil
+	}
+	updated := existing.DeepCopy()
+	if updated.Data == nil {
+		updated.Data = make(map[string][]byte)
+	}
+	updated.Data[AuthorizedKeysKey] = authorizedKey
+	_, err = client.CoreV1().Secrets(secret.Namespace).Update(updated)
+	return err
+}
+
+// parseSSHPiperKey checks the sshpiper key is an unencrypted private key, explaining the usual mistakes of storing
+// the public key, a passphrase-protected key or a key which was base64 encoded twice
+func parseSSHPiperKey(data []byte) (ssh.Signer, error) {
+	invalid := func(format string, args ...interface{}) error {
+		return syncError{reason: ReasonInvalidPrivateKey, err: fmt.Errorf("invalid sshpiper key - "+format, args...)}
+	}
+
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, invalid("missing private key")
+	}
+	if block, _ := pem.Decode(data); block != nil && isEncryptedKey(block) {
+		return nil, invalid("the private key is passphrase protected")
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if err == nil {
+		return signer, nil
+	}
+
+	if _, _, _, _, perr := ssh.ParseAuthorizedKey(data); perr == nil {
+		return nil, invalid("found a public key, the private key belongs here and the public key in %s", AuthorizedKeysKey)
+	}
+	if decoded, derr := base64.StdEncoding.DecodeString(string(data)); derr == nil {
+		if block, _ := pem.Decode(decoded); block != nil || bytes.HasPrefix(bytes.TrimSpace(decoded), []byte("ssh-")) {
+			return nil, invalid("the key is base64 encoded twice")
+		}
+	}
+	return nil, invalid("%v", err)
+}
+
+// isEncryptedKey reports whether the PEM block is protected by a passphrase, in the legacy PEM or OpenSSH format
+func isEncryptedKey(block *pem.Block) bool {
+	if x509.IsEncryptedPEMBlock(block) {
+		return true
+	}
+	if block.Type != "OPENSSH PRIVATE KEY" || !bytes.HasPrefix(block.Bytes, []byte(opensshKeyMagic)) {
+		return false
+	}
+	rest := block.Bytes[len(opensshKeyMagic):]
+	if len(rest) < 4 || int(binary.BigEndian.Uint32(rest)) > len(rest)-4 {
+		return false
+	}
+	return string(rest[4:4+binary.BigEndian.Uint32(rest)]) != "none"
+}
+
+// checkPublicKeySecret verifies the private key matches the authorized_keys of the companion secret when there is
+// one, as the container would otherwise reject sshpiper at login time
+func checkPublicKeySecret(namespace, name string, privateKey []byte, client kubernetes.Interface) error {
+	signer, err := parseSSHPiperKey(privateKey)
+	if err != nil {
+		return err
+	}
+
+	companion, err := client.CoreV1().Secrets(namespace).Get(publicKeySecretName(name), metaV1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	expect := signer.PublicKey().Marshal()
+	rest := companion.Data[AuthorizedKeysKey]
+	for len(rest) > 0 {
+		var key ssh.PublicKey
+		key, _, _, rest, err = ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			break
+		}
+		if bytes.Equal(key.Marshal(), expect) {
+			return nil
+		}
+	}
+	return syncError{
+		reason: ReasonKeyMismatch,
+		err:    fmt.Errorf("the sshpiper key does not match the %s of secret %s", AuthorizedKeysKey, companion.Name),
+	}
+}
+
+// generateSSHPiperKey in PEM form as written by ssh-keygen
+func generateSSHPiperKey() ([]byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, generatedKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), nil
+}
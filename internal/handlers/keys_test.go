@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseSSHPiperKey(t *testing.T) {
+	_, authorizedKey, privateKey := generateKey(t)
+
+	block, _ := pem.Decode(privateKey)
+	encrypted, err := x509.EncryptPEMBlock(rand.Reader, block.Type, block.Bytes, []byte("passphrase"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatalf("failed to encrypt test key - %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		data   []byte
+		expect string
+	}{
+		{name: "private key", data: privateKey},
+		{name: "missing", data: nil, expect: "missing"},
+		{name: "public key", data: authorizedKey, expect: "public key"},
+		{name: "encrypted", data: pem.EncodeToMemory(encrypted), expect: "passphrase"},
+		{name: "double base64", data: []byte(base64.StdEncoding.EncodeToString(privateKey)), expect: "base64"},
+		{name: "double base64 public key", data: []byte(base64.StdEncoding.EncodeToString(authorizedKey)), expect: "base64"},
+		{name: "garbage", data: []byte("not a key"), expect: "sshpiper key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseSSHPiperKey(tt.data)
+			if tt.expect == "" {
+				if err != nil {
+					t.Errorf("unexpected error - %v", err)
+				}
+				return
+			}
+			se, ok := err.(syncError)
+			if !ok || se.reason != ReasonInvalidPrivateKey || !strings.Contains(err.Error(), tt.expect) {
+				t.Errorf("expected %s error mentioning %q - got %v", ReasonInvalidPrivateKey, tt.expect, err)
+			}
+		})
+	}
+}
+
+func TestCheckPublicKeySecret(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	_, _, privateKey := generateKey(t)
+	_, otherKey, _ := generateKey(t)
+
+	if err := checkPublicKeySecret(testNamespace, validNames, privateKey, c); err != nil {
+		t.Errorf("unexpected error without a companion secret - %v", err)
+	}
+
+	companion := &v1.Secret{
+		ObjectMeta: metaV1.ObjectMeta{Name: validNames + PublicKeySecretSuffix, Namespace: testNamespace},
+		Data:       map[string][]byte{AuthorizedKeysKey: otherKey},
+	}
+	if _, err := c.CoreV1().Secrets(testNamespace).Create(companion); err != nil {
+		t.Errorf("error when creating test secret")
+	}
+
+	err := checkPublicKeySecret(testNamespace, validNames, privateKey, c)
+	if se, ok := err.(syncError); !ok || se.reason != ReasonKeyMismatch {
+		t.Errorf("expected %s error - got %v", ReasonKeyMismatch, err)
+	}
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"sync/atomic"
+
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/registry"
+	"go.uber.org/zap"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+// leading is 1 while this replica may write to the registry and the cluster, which is always the case without
+// leader election
+var leading int32 = 1
+
+// SetLeading marks whether this replica holds the lease. Standbys keep their caches warm but skip every event,
+// relying on the reconciliation run when they take over.
+func SetLeading(isLeader bool) {
+	var v int32
+	if isLeader {
+		v = 1
+	}
+	atomic.StoreInt32(&leading, v)
+}
+
+// IsLeading reports whether handlers act on events
+func IsLeading() bool {
+	return atomic.LoadInt32(&leading) == 1
+}
+
+// Pause runs fn once the handlers in flight have completed, holding further events until it returns. Reconciling
+// diffs the cluster against the registry, which handlers writing meanwhile would make stale.
+func Pause(fn func() error) error {
+	paused.Lock()
+	defer paused.Unlock()
+	return fn()
+}
+
+// CatchUp handles the secrets skipped while standing by which reconciliation cannot register, those waiting for the
+// handlers to generate their sshpiper key. SSHExposures are retried by the resync of their informer.
+func CatchUp(client kubernetes.Interface, r registry.Registrable, rec record.EventRecorder, namespaces []string, l *zap.Logger) error {
+	for _, namespace := range namespaces {
+		secrets, err := client.CoreV1().Secrets(namespace).List(metaV1.ListOptions{LabelSelector: ExposeLabelSelector})
+		if err != nil {
+			return err
+		}
+
+		for i := range secrets.Items {
+			secret := &secrets.Items[i]
+			if len(sshPiperKey(secret)) > 0 {
+				continue
+			}
+			// run as this may be called while paused
+			if err = run(resourceSecret, eventCreate, func() error {
+				return syncSecretWithService(secret, client, r, rec, l)
+			}); err != nil {
+				// the next change to the secret is retried by its handler
+				l.Sugar().Errorf("failed to catch up with secret %s/%s - %v", secret.Namespace, secret.Name, err)
+			}
+		}
+	}
+	return nil
+}
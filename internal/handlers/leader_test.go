@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestStandbySkipsEvents(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	l, _ := zap.NewDevelopment()
+	r := &recordingRegistry{}
+
+	SetLeading(false)
+	defer SetLeading(true)
+
+	secret, _, _ := getValidSSHSecret(t)
+	if _, err := c.CoreV1().Services(testNamespace).Create(getValidSSHService(t)); err != nil {
+		t.Errorf("error when creating test service")
+	}
+
+	ch := NewSecretHandler(c, nil, r, record.NewFakeRecorder(10), l).NewCreateHandler()
+	ch.SetObject(secret)
+	if err := ch.Handle(); err != nil {
+		t.Errorf("unexpected error when handling create event - %v", err)
+	}
+	if len(r.registered) != 0 {
+		t.Errorf("unexpected registration by a standby - got %v", r.registered)
+	}
+}
+
+func TestCatchUp(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	l, _ := zap.NewDevelopment()
+	r := &recordingRegistry{}
+
+	keyless, _, _ := getValidSSHSecret(t)
+	delete(keyless.Data, SSHPiperPrivateKeyKey)
+	if _, err := c.CoreV1().Secrets(testNamespace).Create(keyless); err != nil {
+		t.Errorf("error when creating test secret")
+	}
+	keyed, _, _ := getValidSSHSecret(t)
+	keyed.ObjectMeta = metaV1.ObjectMeta{Name: "keyed", Namespace: testNamespace, Labels: keyed.Labels}
+	if _, err := c.CoreV1().Secrets(testNamespace).Create(keyed); err != nil {
+		t.Errorf("error when creating test secret")
+	}
+	if _, err := c.CoreV1().Services(testNamespace).Create(getValidSSHService(t)); err != nil {
+		t.Errorf("error when creating test service")
+	}
+
+	if err := CatchUp(c, r, record.NewFakeRecorder(10), []string{testNamespace}, l); err != nil {
+		t.Errorf("unexpected error when catching up - %v", err)
+	}
+
+	// secrets with a key are left to the reconciliation
+	if len(r.registered) != 1 || r.registered[0].Name != validUpstreamName {
+		t.Errorf("expected only the keyless secret to be registered - got %v", r.registered)
+	}
+	stored, err := c.CoreV1().Secrets(testNamespace).Get(validNames, metaV1.GetOptions{})
+	if err != nil || len(stored.Data[SSHPiperPrivateKeyKey]) == 0 {
+		t.Errorf("expected a key to be generated - got %v, %v", stored, err)
+	}
+}
+
+func TestPauseHoldsEvents(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	l, _ := zap.NewDevelopment()
+	r := &recordingRegistry{}
+
+	secret, _, _ := getValidSSHSecret(t)
+	if _, err := c.CoreV1().Services(testNamespace).Create(getValidSSHService(t)); err != nil {
+		t.Errorf("error when creating test service")
+	}
+
+	paused := make(chan struct{})
+	resume := make(chan struct{})
+	go Pause(func() error {
+		close(paused)
+		<-resume
+		return nil
+	})
+	<-paused
+
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		ch := NewSecretHandler(c, nil, r, record.NewFakeRecorder(10), l).NewCreateHandler()
+		ch.SetObject(secret)
+		if err := ch.Handle(); err != nil {
+			t.Errorf("unexpected error when handling create event - %v", err)
+		}
+	}()
+
+	select {
+	case <-handled:
+		t.Errorf("unexpected event handled while paused")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(resume)
+	<-handled
+	if len(r.registered) != 1 {
+		t.Errorf("expected the event to be handled once resumed - got %v", r.registered)
+	}
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/health"
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/metrics"
+)
+
+// Resources and events the handler metrics are labelled with
+const (
+	resourceSecret   = "secret"
+	resourceService  = "service"
+	resourceExposure = "sshexposure"
+
+	eventCreate = "create"
+	eventUpdate = "update"
+	eventDelete = "delete"
+)
+
+// Reasons of skipped events which record no event of their own
+const (
+	skipUnchanged      = "Unchanged"
+	skipNotRegistered  = "NotRegistered"
+	skipNoSSHPort      = "NoSSHPort"
+	skipSecretNotFound = "SecretNotFound"
+	skipNotLeader      = "NotLeader"
+	skipShuttingDown   = "ShuttingDown"
+)
+
+// skipped is returned by the sync functions when an event leaves the registry untouched for a reason retrying will
+// not change
+type skipped string
+
+func (s skipped) Error() string {
+	return "skipped - " + string(s)
+}
+
+// workers tracks the handler calls in flight
+var workers = health.NewWorkers()
+
+// paused is held by Pause while catching up with the registry, and shared by the handlers
+var paused sync.RWMutex
+
+// CheckWorkers fails when a handler has been running for longer than timeout, leaving its worker unable to process
+// further events
+func CheckWorkers(timeout time.Duration) error {
+	return workers.Check(timeout)
+}
+
+// Drain stops the handlers from acting on further events and waits up to timeout for those in flight to complete.
+// Events skipped meanwhile are caught up with by the reconciliation on the next start.
+func Drain(timeout time.Duration) error {
+	return workers.Drain(timeout)
+}
+
+// observe runs a handler and counts the outcome of the event, swallowing skips so that they are not retried. Events
+// wait for Pause to return.
+func observe(resource, event string, handle func() error) error {
+	paused.RLock()
+	defer paused.RUnlock()
+	return run(resource, event, handle)
+}
+
+// run a handler as observe does, without waiting for Pause, which is what catching up uses
+func run(resource, event string, handle func() error) error {
+	if !IsLeading() {
+		metrics.HandlerEvents.WithLabelValues(resource, event, metrics.OutcomeSkipped, skipNotLeader).Inc()
+		return nil
+	}
+	done, ok := workers.Begin()
+	if !ok {
+		metrics.HandlerEvents.WithLabelValues(resource, event, metrics.OutcomeSkipped, skipShuttingDown).Inc()
+		return nil
+	}
+	defer done()
+
+	switch err := handle().(type) {
+	case nil:
+		metrics.HandlerEvents.WithLabelValues(resource, event, metrics.OutcomeSuccess, "").Inc()
+		return nil
+	case skipped:
+		metrics.HandlerEvents.WithLabelValues(resource, event, metrics.OutcomeSkipped, string(err)).Inc()
+		return nil
+	default:
+		metrics.HandlerEvents.WithLabelValues(resource, event, metrics.OutcomeError, "").Inc()
+		return err
+	}
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"text/template"
+
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// maxUpstreamNameLength is the size of the sshpiper name columns the upstream name is stored in
+const maxUpstreamNameLength = 45
+
+// nameHashLength is the length of the hash suffixed to truncated upstream names, which keep truncatedNameLength
+// characters of the qualified name
+const (
+	nameHashLength      = 8
+	truncatedNameLength = maxUpstreamNameLength - nameHashLength - 1
+)
+
+// usernameTemplate is set from the config on start, secrets without a username annotation fail to sync until then
+var usernameTemplate *template.Template
+
+var errNoUsernameTemplate = errors.New("username template is not set")
+
+// SetUsernameTemplate sets how the default login name is derived from a secret, for example {{.Name}},
+// {{.Namespace}}-{{.Name}} or {{.Namespace}} when each user has their own namespace
+func SetUsernameTemplate(text string) error {
+	t, err := template.New("username").Parse(text)
+	if err != nil {
+		return err
+	}
+	usernameTemplate = t
+	return nil
+}
+
+// upstreamName identifies the upstream across the cluster, so that secrets sharing a name in different
+// namespaces never collide. Names too long for the sshpiper schema are truncated and suffixed with a hash.
+func upstreamName(namespace, name string) string {
+	qualified := namespace + "/" + name
+	if len(qualified) <= maxUpstreamNameLength {
+		return qualified
+	}
+	sum := sha256.Sum256([]byte(qualified))
+	suffix := hex.EncodeToString(sum[:])[:nameHashLength]
+	return qualified[:truncatedNameLength] + "-" + suffix
+}
+
+// inNamespaces reports whether upstreamName may have given the name to an object in one of the namespaces, where
+// NamespaceAll matches any name. Truncated names may only keep part of a long namespace, which is all that is
+// compared then.
+func inNamespaces(name string, namespaces []string) bool {
+	for _, namespace := range namespaces {
+		if namespace == metaV1.NamespaceAll {
+			return true
+		}
+		prefix := namespace + "/"
+		if len(name) == maxUpstreamNameLength && len(prefix) > truncatedNameLength {
+			prefix = prefix[:truncatedNameLength]
+		}
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultUsername renders the username template for the secret
+func defaultUsername(namespace, name string) (string, error) {
+	if usernameTemplate == nil {
+		return "", errNoUsernameTemplate
+	}
+	var b bytes.Buffer
+	err := usernameTemplate.Execute(&b, struct {
+		Namespace string
+		Name      string
+	}{namespace, name})
+	return b.String(), err
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/config"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TestMain sets the username template as the controller does on start
+func TestMain(m *testing.M) {
+	if err := SetUsernameTemplate(config.DefaultUsernameTemplate); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestUpstreamName(t *testing.T) {
+	if name := upstreamName("alice", "ssh-pod"); name != "alice/ssh-pod" {
+		t.Errorf("unexpected upstream name - got %v", name)
+	}
+	if upstreamName("alice", "ssh-pod") == upstreamName("bob", "ssh-pod") {
+		t.Errorf("expected upstream names to differ across namespaces")
+	}
+
+	long := upstreamName(strings.Repeat("a", 40), strings.Repeat("b", 40))
+	if len(long) > maxUpstreamNameLength {
+		t.Errorf("expected upstream name to fit %d characters - got %d", maxUpstreamNameLength, len(long))
+	}
+	if long == upstreamName(strings.Repeat("a", 40), strings.Repeat("b", 41)) {
+		t.Errorf("expected truncated upstream names to remain unique")
+	}
+}
+
+func TestInNamespaces(t *testing.T) {
+	long := strings.Repeat("a", 40)
+	tests := []struct {
+		name       string
+		namespaces []string
+		expect     bool
+	}{
+		{"alice/ssh-pod", []string{"alice"}, true},
+		{"alice/ssh-pod", []string{"bob", "alice"}, true},
+		{"alice/ssh-pod", []string{"ali"}, false},
+		{"alice/ssh-pod", []string{metaV1.NamespaceAll}, true},
+		{upstreamName(long, strings.Repeat("b", 40)), []string{long}, true},
+		{upstreamName(long, strings.Repeat("b", 40)), []string{"alice"}, false},
+	}
+
+	for _, tt := range tests {
+		if in := inNamespaces(tt.name, tt.namespaces); in != tt.expect {
+			t.Errorf("unexpected result for %s in %v, expected %v but got %v", tt.name, tt.namespaces, tt.expect, in)
+		}
+	}
+}
+
+func TestDefaultUsername(t *testing.T) {
+	defer SetUsernameTemplate(config.DefaultUsernameTemplate)
+
+	tests := []struct {
+		template string
+		expect   string
+	}{
+		{config.DefaultUsernameTemplate, "ssh-pod"},
+		{"{{.Namespace}}-{{.Name}}", "alice-ssh-pod"},
+		{"{{.Namespace}}", "alice"},
+	}
+
+	for _, tt := range tests {
+		if err := SetUsernameTemplate(tt.template); err != nil {
+			t.Fatalf("unexpected error parsing template - %v", err)
+		}
+		username, err := defaultUsername("alice", "ssh-pod")
+		if err != nil {
+			t.Errorf("unexpected error rendering template - %v", err)
+		}
+		if username != tt.expect {
+			t.Errorf("unexpected username for %s, expected %s but got %s", tt.template, tt.expect, username)
+		}
+	}
+
+	if err := SetUsernameTemplate("{{.Missing}}"); err != nil {
+		t.Fatalf("unexpected error parsing template - %v", err)
+	}
+	if _, err := defaultUsername("alice", "ssh-pod"); err == nil {
+		t.Errorf("expected error rendering template with unknown field")
+	}
+
+	usernameTemplate = nil
+	if _, err := defaultUsername("alice", "ssh-pod"); err != errNoUsernameTemplate {
+		t.Errorf("expected %v - got %v", errNoUsernameTemplate, err)
+	}
+}
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/exposure"
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/metrics"
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/registry"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// desiredState holds the upstreams expected from the cluster by name, along with the namespace each one comes from
+// and the unqualified name secrets were registered under before upstream names included the namespace
+type desiredState struct {
+	upstreams  map[string]*registry.Upstream
+	namespaces map[string]string
+	legacy     map[string]string
+}
+
+func (d desiredState) add(namespace string, u *registry.Upstream) {
+	d.upstreams[u.Name] = u
+	d.namespaces[u.Name] = namespace
+}
+
+// drift between the desired upstreams and those registered
+type drift struct {
+	missing, changed, orphaned []*registry.Upstream
+	// registered counts the desired upstreams found in the registry by namespace
+	registered map[string]int
+}
+
+// Reconcile diffs the registry against the exposed secrets, services and SSHExposures in the given namespaces.
+// Missing upstreams are added, changed upstreams are updated and only upstreams of the namespaces with no matching
+// secret and service or exposure are removed, so that users keep access across controller restarts. Nothing is
+// changed unless the cluster could be listed in full, as upstreams missing from a partial view would be removed.
+// Rows registered under the unqualified secret name are replaced by the qualified upstream.
+func Reconcile(client kubernetes.Interface, exposures dynamic.Interface, r registry.Registrable, namespaces []string, l *zap.Logger) error {
+	d, err := diffRegistry(client, exposures, r, namespaces, l)
+	if err != nil {
+		return err
+	}
+
+	// orphans go first to release their usernames, which the upstreams replacing them may register again
+	for _, u := range d.orphaned {
+		if err = r.UnregisterUpstream(u); err != nil {
+			return err
+		}
+	}
+	for _, u := range append(d.missing, d.changed...) {
+		// registering updates the stored upstream in place
+		if err = registerUpstream(r, u, l); err != nil {
+			return err
+		}
+	}
+
+	l.Info("Registry reconciled", zap.Int("added", len(d.missing)), zap.Int("updated", len(d.changed)), zap.Int("removed", len(d.orphaned)))
+	return nil
+}
+
+// Audit diffs the registry against the cluster like Reconcile but only reports the drift in the metrics, leaving
+// the handlers to correct it
+func Audit(client kubernetes.Interface, exposures dynamic.Interface, r registry.Registrable, namespaces []string, l *zap.Logger) error {
+	d, err := diffRegistry(client, exposures, r, namespaces, l)
+	if err != nil {
+		return err
+	}
+	metrics.SetDrift(metrics.Drift{
+		Missing:    len(d.missing),
+		Changed:    len(d.changed),
+		Orphaned:   len(d.orphaned),
+		Registered: d.registered,
+	})
+	return nil
+}
+
+func diffRegistry(client kubernetes.Interface, exposures dynamic.Interface, r registry.Registrable, namespaces []string, l *zap.Logger) (*drift, error) {
+	desired := desiredState{
+		upstreams:  make(map[string]*registry.Upstream),
+		namespaces: make(map[string]string),
+		legacy:     make(map[string]string),
+	}
+	if err := desiredUpstreams(client, namespaces, desired, l); err != nil {
+		return nil, err
+	}
+	if err := desiredExposureUpstreams(client, exposures, namespaces, desired, l); err != nil {
+		return nil, err
+	}
+
+	current, err := r.ListUpstreams()
+	if err != nil {
+		return nil, err
+	}
+
+	registered := make(map[string]*registry.Upstream, len(current))
+	for _, u := range current {
+		registered[u.Name] = u
+	}
+
+	d := &drift{registered: make(map[string]int)}
+	// legacy rows replaced by a missing upstream, which are orphans whichever namespaces are watched
+	replaced := make(map[string]bool)
+	for name, u := range desired.upstreams {
+		existing, ok := registered[name]
+		if !ok {
+			d.missing = append(d.missing, u)
+			if legacy, ok := desired.legacy[name]; ok && registered[legacy] != nil {
+				replaced[legacy] = true
+			}
+			continue
+		}
+		d.registered[desired.namespaces[name]]++
+		if upstreamChanged(existing, u) {
+			d.changed = append(d.changed, u)
+		}
+	}
+
+	for name, u := range registered {
+		// upstreams of namespaces watched by another instance are left to it
+		if _, ok := desired.upstreams[name]; !ok && (inNamespaces(name, namespaces) || replaced[name]) {
+			d.orphaned = append(d.orphaned, u)
+		}
+	}
+	return d, nil
+}
+
+// desiredUpstreams builds the upstreams expected from the exposed secrets which have a matching service
+func desiredUpstreams(client kubernetes.Interface, namespaces []string, desired desiredState, l *zap.Logger) error {
+	for _, namespace := range namespaces {
+		secrets, err := client.CoreV1().Secrets(namespace).List(metaV1.ListOptions{LabelSelector: ExposeLabelSelector})
+		if err != nil {
+			return err
+		}
+
+		for i := range secrets.Items {
+			secret := &secrets.Items[i]
+			service, err := getSSHService(secret.Name, secret.Namespace, client)
+			if err != nil && !errors.IsNotFound(err) {
+				// the upstream would be taken for an orphan, only a complete view of the cluster is safe to act on
+				return err
+			}
+			if service == nil {
+				// the service handler will register the upstream once the service appears
+				continue
+			}
+
+			u, err := getUpstreamFromSecret(secret)
+			if err != nil {
+				// parse errors are all there is, the secret is invalid until it changes
+				l.Sugar().Errorf("failed to parse secret %s/%s - %v", secret.Namespace, secret.Name, err)
+				continue
+			}
+			u.Address = sshAddress(service)
+			desired.add(secret.Namespace, u)
+			desired.legacy[u.Name] = secret.Name
+		}
+	}
+	return nil
+}
+
+// desiredExposureUpstreams adds the upstreams expected from the SSHExposures which can be resolved
+func desiredExposureUpstreams(client kubernetes.Interface, exposures dynamic.Interface, namespaces []string, desired desiredState, l *zap.Logger) error {
+	for _, namespace := range namespaces {
+		list, err := exposures.Resource(exposure.GroupVersionResource).Namespace(namespace).List(metaV1.ListOptions{})
+		if errors.IsNotFound(err) {
+			// the custom resource definition is not installed so there can be no exposures
+			l.Debug("SSHExposure resource not found, skipping exposures", zap.String("namespace", namespace))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for i := range list.Items {
+			e, err := exposure.FromUnstructured(&list.Items[i])
+			if err != nil {
+				l.Sugar().Errorf("failed to parse exposure %s/%s - %v", list.Items[i].GetNamespace(), list.Items[i].GetName(), err)
+				continue
+			}
+			u, err := getUpstreamFromExposure(e, client)
+			if _, ok := err.(syncError); ok {
+				// the exposure handler will register the upstream once it can be resolved
+				l.Sugar().Debugf("failed to resolve exposure %s/%s - %v", e.Namespace, e.Name, err)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			desired.add(e.Namespace, u)
+		}
+	}
+	return nil
+}
+
+// upstreamChanged compares the stored and desired upstreams ignoring the order of public keys. Trusted user CAs and
+// upstream host keys are not compared as the MySQL schema has nowhere to store them.
+func upstreamChanged(current, desired *registry.Upstream) bool {
+	sortedKeys := func(keys []string) []string {
+		sorted := append([]string{}, keys...)
+		sort.Strings(sorted)
+		return sorted
+	}
+
+	return current.Username != desired.Username ||
+		current.UpstreamUsername != desired.UpstreamUsername ||
+		current.Address != desired.Address ||
+		current.SSHPiperPrivateKey != desired.SSHPiperPrivateKey ||
+		!reflect.DeepEqual(sortedKeys(current.DownstreamPublicKey), sortedKeys(desired.DownstreamPublicKey))
+}
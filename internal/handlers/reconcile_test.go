@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/metrics"
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/registry"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+)
+
+func TestReconcile(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	l, _ := zap.NewDevelopment()
+
+	secret, s, b64 := getValidSSHSecret(t)
+	if _, err := c.CoreV1().Secrets(testNamespace).Create(secret); err != nil {
+		t.Errorf("error when creating test secret")
+	}
+	if _, err := c.CoreV1().Services(testNamespace).Create(getValidSSHService(t)); err != nil {
+		t.Errorf("error when creating test service")
+	}
+
+	changed, _, _ := getValidSSHSecret(t)
+	changed.ObjectMeta = metaV1.ObjectMeta{Name: "changed", Namespace: testNamespace, Labels: changed.Labels}
+	if _, err := c.CoreV1().Secrets(testNamespace).Create(changed); err != nil {
+		t.Errorf("error when creating test secret")
+	}
+	changedService := getValidSSHService(t)
+	changedService.Name = "changed"
+	if _, err := c.CoreV1().Services(testNamespace).Create(changedService); err != nil {
+		t.Errorf("error when creating test service")
+	}
+
+	r := &recordingRegistry{
+		upstreams: []*registry.Upstream{
+			{Name: testNamespace + "/changed", Username: "changed", Address: "10.0.0.1"},
+			{Name: testNamespace + "/orphan", Username: "orphan", Address: "10.0.0.2"},
+		},
+	}
+
+	if err := Reconcile(c, newFakeDynamicClient(getValidSSHExposure(t, string(secret.Data[DownstreamPublicKeyKey]))), r, []string{testNamespace}, l); err != nil {
+		t.Errorf("unexpected error when reconciling - %v", err)
+	}
+
+	expect := &registry.Upstream{
+		Name:                validUpstreamName,
+		Username:            validNames,
+		UpstreamUsername:    validNames,
+		Address:             staticAddress,
+		SSHPiperPrivateKey:  s,
+		DownstreamPublicKey: b64,
+	}
+	registered := r.registeredByName()
+	if !reflect.DeepEqual(registered[validUpstreamName], expect) {
+		t.Errorf("unexpected result, expected \n %v \n but got \n%v", expect, registered[validUpstreamName])
+	}
+	if registered[testNamespace+"/changed"] == nil || registered[testNamespace+"/changed"].Address != staticAddress {
+		t.Errorf("expected changed upstream to be re-registered - got %v", registered[testNamespace+"/changed"])
+	}
+	if registered[exposureUpstreamName(testNamespace, validExposureName)] == nil {
+		t.Errorf("expected exposure upstream to be registered - got %v", registered)
+	}
+
+	if !reflect.DeepEqual(r.unregistered, []string{testNamespace + "/orphan"}) {
+		t.Errorf("unexpected upstreams unregistered - got %v", r.unregistered)
+	}
+}
+
+func TestReconcileUnchanged(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	l, _ := zap.NewDevelopment()
+
+	secret, s, b64 := getValidSSHSecret(t)
+	if _, err := c.CoreV1().Secrets(testNamespace).Create(secret); err != nil {
+		t.Errorf("error when creating test secret")
+	}
+	if _, err := c.CoreV1().Services(testNamespace).Create(getValidSSHService(t)); err != nil {
+		t.Errorf("error when creating test service")
+	}
+
+	r := &recordingRegistry{
+		upstreams: []*registry.Upstream{
+			{Name: validUpstreamName, Username: validNames, UpstreamUsername: validNames, Address: staticAddress, SSHPiperPrivateKey: s, DownstreamPublicKey: b64},
+		},
+	}
+
+	if err := Reconcile(c, newFakeDynamicClient(), r, []string{testNamespace}, l); err != nil {
+		t.Errorf("unexpected error when reconciling - %v", err)
+	}
+	if len(r.registered) != 0 || len(r.unregistered) != 0 {
+		t.Errorf("expected no changes - registered %v, unregistered %v", r.registered, r.unregistered)
+	}
+}
+
+func TestReconcileLeavesOtherNamespaces(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	l, _ := zap.NewDevelopment()
+
+	r := &recordingRegistry{
+		upstreams: []*registry.Upstream{
+			{Name: testNamespace + "/orphan", Username: "orphan", Address: "10.0.0.1"},
+			{Name: "other/ssh-pod", Username: "ssh-pod", Address: "10.0.0.2"},
+		},
+	}
+
+	if err := Reconcile(c, newFakeDynamicClient(), r, []string{testNamespace}, l); err != nil {
+		t.Errorf("unexpected error when reconciling - %v", err)
+	}
+	if !reflect.DeepEqual(r.unregistered, []string{testNamespace + "/orphan"}) {
+		t.Errorf("expected only the orphan of the watched namespace to be unregistered - got %v", r.unregistered)
+	}
+}
+
+func TestReconcileMigratesLegacyNames(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	l, _ := zap.NewDevelopment()
+
+	secret, s, b64 := getValidSSHSecret(t)
+	if _, err := c.CoreV1().Secrets(testNamespace).Create(secret); err != nil {
+		t.Errorf("error when creating test secret")
+	}
+	if _, err := c.CoreV1().Services(testNamespace).Create(getValidSSHService(t)); err != nil {
+		t.Errorf("error when creating test service")
+	}
+
+	// registered before upstream names were qualified with the namespace, holding the username
+	m := registry.NewMemory(l)
+	legacy := &registry.Upstream{Name: validNames, Username: validNames, UpstreamUsername: validNames, Address: staticAddress, SSHPiperPrivateKey: s, DownstreamPublicKey: b64}
+	if _, err := m.RegisterUpstream(legacy); err != nil {
+		t.Fatalf("error registering the legacy upstream - %v", err)
+	}
+
+	if err := Reconcile(c, newFakeDynamicClient(), m, []string{testNamespace}, l); err != nil {
+		t.Errorf("unexpected error when reconciling - %v", err)
+	}
+
+	u, ok := m.Lookup(validNames)
+	if !ok || u.Name != validUpstreamName {
+		t.Errorf("expected the username to route to %s - got %v", validUpstreamName, u)
+	}
+	upstreams, _ := m.ListUpstreams()
+	if len(upstreams) != 1 {
+		t.Errorf("expected the legacy upstream to be replaced - got %v", upstreams)
+	}
+}
+
+func TestReconcileAbortsOnAPIErrors(t *testing.T) {
+	secret, s, b64 := getValidSSHSecret(t)
+	tests := []struct {
+		name     string
+		resource string
+	}{
+		{name: "service", resource: "services"},
+		{name: "exposure secret", resource: "secrets"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := fake.NewSimpleClientset(secret.DeepCopy(), getValidSSHService(t))
+			c.PrependReactor("get", tt.resource, func(action k8sTesting.Action) (bool, runtime.Object, error) {
+				return true, nil, errors.NewServiceUnavailable("throttled")
+			})
+			l, _ := zap.NewDevelopment()
+
+			r := &recordingRegistry{
+				upstreams: []*registry.Upstream{
+					{Name: validUpstreamName, Username: validNames, UpstreamUsername: validNames, Address: staticAddress, SSHPiperPrivateKey: s, DownstreamPublicKey: b64},
+					{Name: exposureUpstreamName(testNamespace, validExposureName), Username: "exposed", Address: staticAddress},
+				},
+			}
+
+			exposures := newFakeDynamicClient(getValidSSHExposure(t, string(secret.Data[DownstreamPublicKeyKey])))
+			if err := Reconcile(c, exposures, r, []string{testNamespace}, l); err == nil {
+				t.Errorf("expected the error to abort reconciling")
+			}
+			if len(r.registered) != 0 || len(r.unregistered) != 0 {
+				t.Errorf("expected no changes - registered %v, unregistered %v", r.registered, r.unregistered)
+			}
+		})
+	}
+}
+
+func TestAudit(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	l, _ := zap.NewDevelopment()
+
+	secret, s, b64 := getValidSSHSecret(t)
+	if _, err := c.CoreV1().Secrets(testNamespace).Create(secret); err != nil {
+		t.Errorf("error when creating test secret")
+	}
+	if _, err := c.CoreV1().Services(testNamespace).Create(getValidSSHService(t)); err != nil {
+		t.Errorf("error when creating test service")
+	}
+
+	r := &recordingRegistry{
+		upstreams: []*registry.Upstream{
+			{Name: validUpstreamName, Username: validNames, UpstreamUsername: validNames, Address: staticAddress, SSHPiperPrivateKey: s, DownstreamPublicKey: b64},
+			{Name: testNamespace + "/orphan", Username: "orphan", Address: "10.0.0.2"},
+		},
+	}
+
+	exposures := newFakeDynamicClient(getValidSSHExposure(t, string(secret.Data[DownstreamPublicKeyKey])))
+	if err := Audit(c, exposures, r, []string{testNamespace}, l); err != nil {
+		t.Errorf("unexpected error when auditing - %v", err)
+	}
+	if len(r.registered) != 0 || len(r.unregistered) != 0 {
+		t.Errorf("expected the audit to leave the registry alone - registered %v, unregistered %v", r.registered, r.unregistered)
+	}
+
+	gauges := map[string]prometheus.Gauge{
+		"registered":          metrics.RegisteredUpstreams.WithLabelValues(testNamespace),
+		metrics.DriftMissing:  metrics.RegistryDrift.WithLabelValues(metrics.DriftMissing),
+		metrics.DriftChanged:  metrics.RegistryDrift.WithLabelValues(metrics.DriftChanged),
+		metrics.DriftOrphaned: metrics.RegistryDrift.WithLabelValues(metrics.DriftOrphaned),
+	}
+	// the exposure is missing and the orphan has no object in the cluster
+	expect := map[string]float64{"registered": 1, metrics.DriftMissing: 1, metrics.DriftChanged: 0, metrics.DriftOrphaned: 1}
+	for name, gauge := range gauges {
+		if value := testutil.ToFloat64(gauge); value != expect[name] {
+			t.Errorf("unexpected %s gauge, expected %v but got %v", name, expect[name], value)
+		}
+	}
+}
+
+type recordingRegistry struct {
+	upstreams    []*registry.Upstream
+	registered   []*registry.Upstream
+	unregistered []string
+}
+
+func (rr *recordingRegistry) RegisterUpstream(upstream *registry.Upstream) (*registry.Upstream, error) {
+	rr.registered = append(rr.registered, upstream)
+	return upstream, nil
+}
+
+func (rr *recordingRegistry) UnregisterUpstream(upstream *registry.Upstream) error {
+	rr.unregistered = append(rr.unregistered, upstream.Name)
+	return nil
+}
+
+func (rr *recordingRegistry) ListUpstreams() ([]*registry.Upstream, error) {
+	return rr.upstreams, nil
+}
+
+func (rr *recordingRegistry) registeredByName() map[string]*registry.Upstream {
+	byName := make(map[string]*registry.Upstream)
+	for _, u := range rr.registered {
+		byName[u.Name] = u
+	}
+	return byName
+}
@@ -0,0 +1,425 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/exposure"
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/registry"
+	controller "github.com/philipgough/kube-kontroller"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+type (
+	SSHExposureHandler struct {
+		client    kubernetes.Interface
+		exposures dynamic.Interface
+		registry  registry.Registrable
+		recorder  record.EventRecorder
+		logger    *zap.Logger
+	}
+
+	CreateExposureHandler struct {
+		client    kubernetes.Interface
+		exposures dynamic.Interface
+		registry  registry.Registrable
+		recorder  record.EventRecorder
+		logger    *zap.Logger
+		newValue  interface{}
+	}
+
+	UpdateExposureHandler struct {
+		client    kubernetes.Interface
+		exposures dynamic.Interface
+		registry  registry.Registrable
+		recorder  record.EventRecorder
+		logger    *zap.Logger
+		newValue  interface{}
+		oldValue  interface{}
+	}
+
+	DeleteExposureHandler struct {
+		client    kubernetes.Interface
+		exposures dynamic.Interface
+		registry  registry.Registrable
+		recorder  record.EventRecorder
+		logger    *zap.Logger
+		oldValue  interface{}
+	}
+
+	// Dependents syncs the SSHExposures routed through a service or secret when it changes, which leaves the
+	// generation of the exposures alone. A nil *Dependents has nothing to sync.
+	Dependents struct {
+		exposures cache.Indexer
+		handler   SSHExposureHandler
+	}
+)
+
+// NewExposureHandler registers SSHExposure resources, reporting the outcome on their status
+func NewExposureHandler(c kubernetes.Interface, d dynamic.Interface, r registry.Registrable, rec record.EventRecorder, l *zap.Logger) SSHExposureHandler {
+	return SSHExposureHandler{
+		client:    c,
+		exposures: d,
+		registry:  r,
+		recorder:  rec,
+		logger:    l,
+	}
+}
+
+// Dependents of the services and secrets among the exposures cached by the informer, indexed by exposure.Indexers
+func (h SSHExposureHandler) Dependents(exposures cache.Indexer) *Dependents {
+	return &Dependents{
+		exposures: exposures,
+		handler:   h,
+	}
+}
+
+func (h SSHExposureHandler) NewCreateHandler() controller.HandleCreate {
+	return &CreateExposureHandler{
+		client:    h.client,
+		exposures: h.exposures,
+		registry:  h.registry,
+		recorder:  h.recorder,
+		logger:    h.logger,
+	}
+}
+
+func (h SSHExposureHandler) NewUpdateHandler() controller.HandleUpdate {
+	return &UpdateExposureHandler{
+		client:    h.client,
+		exposures: h.exposures,
+		registry:  h.registry,
+		recorder:  h.recorder,
+		logger:    h.logger,
+	}
+}
+
+func (h SSHExposureHandler) NewDeleteHandler() controller.HandleDelete {
+	return &DeleteExposureHandler{
+		client:    h.client,
+		exposures: h.exposures,
+		registry:  h.registry,
+		recorder:  h.recorder,
+		logger:    h.logger,
+	}
+}
+
+func (ch *CreateExposureHandler) Handle() error {
+	return observe(resourceExposure, eventCreate, ch.handle)
+}
+
+func (ch *CreateExposureHandler) handle() error {
+	object, ok := ch.newValue.(*unstructured.Unstructured)
+	if !ok {
+		return handleTypeAssertionError(ch.logger, ch.newValue)
+	}
+	return syncExposure(object, false, ch.client, ch.exposures, ch.registry, ch.recorder, ch.logger)
+}
+
+func (ch *CreateExposureHandler) SetObject(object interface{}) {
+	ch.newValue = object
+}
+
+func (uh *UpdateExposureHandler) Handle() error {
+	return observe(resourceExposure, eventUpdate, uh.handle)
+}
+
+func (uh *UpdateExposureHandler) handle() error {
+	old, ok := uh.oldValue.(*unstructured.Unstructured)
+	if !ok {
+		return handleTypeAssertionError(uh.logger, uh.oldValue)
+	}
+
+	new, ok := uh.newValue.(*unstructured.Unstructured)
+	if !ok {
+		return handleTypeAssertionError(uh.logger, uh.newValue)
+	}
+
+	if old.GetResourceVersion() != new.GetResourceVersion() && old.GetGeneration() == new.GetGeneration() {
+		// the spec is unchanged, including when only our own status was written
+		return skipped(skipUnchanged)
+	}
+	// resyncs check the registration still matches the service and secret, which may have changed meanwhile
+	recheck := old.GetResourceVersion() == new.GetResourceVersion()
+	return syncExposure(new, recheck, uh.client, uh.exposures, uh.registry, uh.recorder, uh.logger)
+}
+
+func (uh *UpdateExposureHandler) SetObjects(old, new interface{}) {
+	uh.oldValue = old
+	uh.newValue = new
+}
+
+func (dh *DeleteExposureHandler) Handle() error {
+	return observe(resourceExposure, eventDelete, dh.handle)
+}
+
+func (dh *DeleteExposureHandler) handle() error {
+	object, ok := dh.oldValue.(*unstructured.Unstructured)
+	if !ok {
+		return handleTypeAssertionError(dh.logger, dh.oldValue)
+	}
+
+	u := &registry.Upstream{
+		Name: exposureUpstreamName(object.GetNamespace(), object.GetName()),
+	}
+	err := dh.registry.UnregisterUpstream(u)
+	switch err {
+	case nil:
+		dh.logger.Info("SSHExposure removed", zap.String("name", object.GetName()), zap.String("namespace", object.GetNamespace()))
+		return nil
+	case sql.ErrNoRows:
+		dh.logger.Debug("no upstream to unregister for exposure", zap.String("name", object.GetName()), zap.String("namespace", object.GetNamespace()))
+		return skipped(skipNotRegistered)
+	default:
+		// potentially a transient error so retries within the limits are worth doing
+		return err
+	}
+}
+
+func (dh *DeleteExposureHandler) SetObject(object interface{}) {
+	dh.oldValue = object
+}
+
+// exposureUpstreamName identifies the upstream of an exposure, qualified by kind so that it never collides with a
+// secret of the same name. Object names cannot contain a colon.
+func exposureUpstreamName(namespace, name string) string {
+	return upstreamName(namespace, "sshexposure:"+name)
+}
+
+// sync the exposures referring to the object through the index. Failures are only logged, the resync of the
+// exposures retries them.
+func (d *Dependents) sync(index, namespace, name string) {
+	if d == nil {
+		return
+	}
+	h := d.handler
+	objects, err := d.exposures.ByIndex(index, exposure.IndexKey(namespace, name))
+	if err != nil {
+		h.logger.Error("failed to look up dependent exposures", zap.String("index", index), zap.String("name", name), zap.String("namespace", namespace), zap.Error(err))
+		return
+	}
+	for _, obj := range objects {
+		object, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		// cached objects are shared with the informer
+		err = syncExposure(object.DeepCopy(), true, h.client, h.exposures, h.registry, h.recorder, h.logger)
+		if _, ok := err.(skipped); err != nil && !ok {
+			h.logger.Error("failed to sync dependent exposure", zap.String("name", object.GetName()), zap.String("namespace", object.GetNamespace()), zap.Error(err))
+		}
+	}
+}
+
+// exposureRegistered reports whether the current generation of the exposure is registered as the upstream
+func exposureRegistered(e *exposure.SSHExposure, u *registry.Upstream) bool {
+	return e.Status.Registered && e.Status.ObservedGeneration == e.Generation && e.Status.UpstreamChecksum == upstreamChecksum(u)
+}
+
+// upstreamChecksum identifies what an exposure is registered as without storing its keys on the status
+func upstreamChecksum(u *registry.Upstream) string {
+	b, _ := json.Marshal(u)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// syncExposure registers the upstream described by the exposure, recording the outcome as events and on its
+// status. Exposures which cannot be resolved are unregistered, as their service or secret may be gone. With
+// recheck set, exposures already registered as the resolved upstream are left alone. Events left unregistered for
+// good are returned as skipped, any other error is worth retrying.
+func syncExposure(object *unstructured.Unstructured, recheck bool, client kubernetes.Interface, exposures dynamic.Interface, r registry.Registrable, rec record.EventRecorder, l *zap.Logger) error {
+	e, err := exposure.FromUnstructured(object)
+	if err != nil {
+		l.Sugar().Errorf("failed to parse exposure %s/%s - %v", object.GetNamespace(), object.GetName(), err)
+		rec.Event(object, v1.EventTypeWarning, ReasonInvalidExposure, err.Error())
+		return skipped(ReasonInvalidExposure)
+	}
+
+	u, err := getUpstreamFromExposure(e, client)
+	if err != nil {
+		se, ok := err.(syncError)
+		if !ok {
+			// transient api errors are worth retrying
+			return err
+		}
+		l.Sugar().Errorf("failed to resolve exposure %s/%s - %v", e.Namespace, e.Name, err)
+		if err = unregisterExposure(e, r, l); err != nil {
+			return err
+		}
+		rec.Event(object, v1.EventTypeWarning, se.reason, se.Error())
+		clearExposureStatus(exposures, e, se.reason, se.Error(), l)
+		return skipped(se.reason)
+	}
+	if recheck && exposureRegistered(e, u) {
+		return skipped(skipUnchanged)
+	}
+
+	_, err = r.RegisterUpstream(u)
+	switch err {
+	case nil:
+	case registry.ErrUsernameTaken:
+		// retrying will not help until one of the conflicting exposures changes. The registration of a previous
+		// generation no longer matches the spec, so it is removed rather than left routing the old username.
+		if err = unregisterExposure(e, r, l); err != nil {
+			return err
+		}
+		message := fmt.Sprintf("username %s is already registered to another upstream", u.Username)
+		rec.Event(object, v1.EventTypeWarning, ReasonUsernameTaken, message)
+		clearExposureStatus(exposures, e, ReasonUsernameTaken, message, l)
+		return skipped(ReasonUsernameTaken)
+	default:
+		// potentially a transient error so retries within the limits are worth doing
+		rec.Eventf(object, v1.EventTypeWarning, ReasonDatabaseError, "failed to register upstream - %v", err)
+		return err
+	}
+
+	message := fmt.Sprintf("registered as %s for %s", u.Username, u.Address)
+	rec.Event(object, v1.EventTypeNormal, ReasonRegistered, message)
+	warnUnverifiedCertificates(object, u, r, rec)
+	now := metaV1.Now()
+	updateExposureStatus(exposures, e, exposure.Status{
+		Registered:       true,
+		Reason:           ReasonRegistered,
+		Message:          message,
+		Username:         u.Username,
+		Address:          u.Address,
+		LastSynced:       &now,
+		UpstreamChecksum: upstreamChecksum(u),
+	}, l)
+	return nil
+}
+
+// unregisterExposure removes the upstream of the exposure, which is not registered when it never resolved
+func unregisterExposure(e *exposure.SSHExposure, r registry.Registrable, l *zap.Logger) error {
+	err := r.UnregisterUpstream(&registry.Upstream{Name: exposureUpstreamName(e.Namespace, e.Name)})
+	switch err {
+	case nil:
+		l.Info("SSHExposure unregistered", zap.String("name", e.Name), zap.String("namespace", e.Namespace))
+		return nil
+	case sql.ErrNoRows:
+		return nil
+	default:
+		return err
+	}
+}
+
+// updateExposureStatus merges the status of the registration of the current generation. Failures are only logged as
+// the outcome is also an event.
+func updateExposureStatus(exposures dynamic.Interface, e *exposure.SSHExposure, status exposure.Status, l *zap.Logger) {
+	status.ObservedGeneration = e.Generation
+	patchExposureStatus(exposures, e, status, l)
+}
+
+// clearExposureStatus records why the exposure is not registered, removing what it was last registered as
+func clearExposureStatus(exposures dynamic.Interface, e *exposure.SSHExposure, reason, message string, l *zap.Logger) {
+	patchExposureStatus(exposures, e, map[string]interface{}{
+		"observedGeneration": e.Generation,
+		"registered":         false,
+		"reason":             reason,
+		"message":            message,
+		"username":           nil,
+		"address":            nil,
+		"upstreamChecksum":   nil,
+	}, l)
+}
+
+func patchExposureStatus(exposures dynamic.Interface, e *exposure.SSHExposure, status interface{}, l *zap.Logger) {
+	patch, err := json.Marshal(map[string]interface{}{"status": status})
+	if err == nil {
+		_, err = exposures.Resource(exposure.GroupVersionResource).Namespace(e.Namespace).
+			Patch(e.Name, types.MergePatchType, patch, metaV1.PatchOptions{}, "status")
+	}
+	if err != nil {
+		l.Sugar().Errorf("failed to update status of exposure %s/%s - %v", e.Namespace, e.Name, err)
+	}
+}
+
+// getUpstreamFromExposure resolves the service and private key secret the exposure refers to
+func getUpstreamFromExposure(e *exposure.SSHExposure, client kubernetes.Interface) (*registry.Upstream, error) {
+	service, err := client.CoreV1().Services(e.Namespace).Get(e.Spec.ServiceName, metaV1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, syncError{reason: ReasonServiceNotFound, err: fmt.Errorf("service %s not found", e.Spec.ServiceName)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	port, ok := selectSSHPort(service, e.Spec.Port)
+	if !ok || !hasClusterIP(service) {
+		return nil, syncError{reason: ReasonServiceNotFound, err: fmt.Errorf("service %s has no usable ssh port", e.Spec.ServiceName)}
+	}
+
+	secretName := e.Spec.PrivateKeySecretRef.Name
+	secret, err := client.CoreV1().Secrets(e.Namespace).Get(secretName, metaV1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, syncError{reason: ReasonInvalidSecret, err: fmt.Errorf("private key secret %s not found", secretName)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	privateKey := secret.Data[e.Spec.PrivateKeySecretRef.Key]
+	if e.Spec.PrivateKeySecretRef.Key == "" {
+		privateKey = sshPiperKey(secret)
+	}
+	if len(privateKey) == 0 {
+		return nil, syncError{reason: ReasonInvalidSecret, err: fmt.Errorf("private key secret %s has no %s key", secretName, e.Spec.PrivateKeyKey())}
+	}
+	if err = checkPublicKeySecret(e.Namespace, secretName, privateKey, client); err != nil {
+		return nil, err
+	}
+
+	downstreamPublicKeys, err := parseAuthorizedKeys([]byte(strings.Join(e.Spec.AuthorizedKeys, "\n")))
+	if err != nil {
+		return nil, err
+	}
+	trustedUserCAKeys, err := parseKeys([]byte(strings.Join(e.Spec.TrustedUserCAKeys, "\n")), "trusted user CA key")
+	if err != nil {
+		return nil, err
+	}
+	upstreamHostKeys, err := parseKeys([]byte(strings.Join(e.Spec.UpstreamHostKeys, "\n")), "upstream host key")
+	if err != nil {
+		return nil, err
+	}
+	if len(downstreamPublicKeys) == 0 && len(trustedUserCAKeys) == 0 {
+		return nil, syncError{reason: ReasonInvalidExposure, err: fmt.Errorf("either authorizedKeys or trustedUserCAKeys is required")}
+	}
+
+	username := strings.TrimSpace(e.Spec.Username)
+	if username == "" {
+		if username, err = defaultUsername(e.Namespace, e.Name); err != nil {
+			return nil, syncError{reason: ReasonInvalidExposure, err: err}
+		}
+	}
+	upstreamUsername := strings.TrimSpace(e.Spec.UpstreamUsername)
+	if upstreamUsername == "" {
+		upstreamUsername = e.Name
+	}
+
+	upstream := &registry.Upstream{
+		Name:                exposureUpstreamName(e.Namespace, e.Name),
+		Username:            username,
+		UpstreamUsername:    upstreamUsername,
+		Address:             serviceAddress(service, port),
+		SSHPiperPrivateKey:  string(privateKey),
+		DownstreamPublicKey: downstreamPublicKeys,
+		TrustedUserCAKeys:   trustedUserCAKeys,
+		Principals:          e.Spec.Principals,
+		UpstreamHostKeys:    upstreamHostKeys,
+	}
+	if err = upstream.Validate(); err != nil {
+		return nil, syncError{reason: ReasonInvalidExposure, err: err}
+	}
+	return upstream, nil
+}
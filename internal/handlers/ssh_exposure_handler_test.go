@@ -0,0 +1,352 @@
+package handlers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/exposure"
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/registry"
+	"go.uber.org/zap"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicFake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+const validExposureName = "exposure"
+
+func TestSSHExposureHandlerCreate(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	l, _ := zap.NewDevelopment()
+
+	secret, s, b64 := getValidSSHSecret(t)
+	if _, err := c.CoreV1().Secrets(testNamespace).Create(secret); err != nil {
+		t.Errorf("error when creating test secret")
+	}
+	if _, err := c.CoreV1().Services(testNamespace).Create(getValidSSHService(t)); err != nil {
+		t.Errorf("error when creating test service")
+	}
+
+	object := getValidSSHExposure(t, string(secret.Data[DownstreamPublicKeyKey]))
+	d := newFakeDynamicClient(object)
+	handler := NewExposureHandler(c, d, mockRegistry{}, record.NewFakeRecorder(10), l)
+
+	ch := handler.NewCreateHandler()
+	ch.SetObject(object)
+
+	if err := ch.Handle(); err != nil {
+		t.Errorf("unexpected error when handling create event - %v", err)
+	}
+
+	upstream := <-resultChan
+	result, ok := upstream.(*registry.Upstream)
+	if !ok {
+		t.Errorf("unexpected type assertion - got %v", result)
+	}
+
+	expect := &registry.Upstream{
+		Name:                exposureUpstreamName(testNamespace, validExposureName),
+		Username:            "alice",
+		UpstreamUsername:    validExposureName,
+		Address:             staticAddress,
+		SSHPiperPrivateKey:  s,
+		DownstreamPublicKey: b64,
+	}
+
+	if !reflect.DeepEqual(result, expect) {
+		t.Errorf("unexpected result, expected \n %v \n but got \n%v", expect, result)
+	}
+
+	status := getExposureStatus(t, d)
+	if !status.Registered || status.Username != "alice" || status.Address != staticAddress || status.ObservedGeneration != 1 {
+		t.Errorf("unexpected status - got %+v", status)
+	}
+}
+
+func TestSSHExposureHandlerCreateWithoutService(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	l, _ := zap.NewDevelopment()
+	recorder := record.NewFakeRecorder(10)
+
+	secret, _, _ := getValidSSHSecret(t)
+	if _, err := c.CoreV1().Secrets(testNamespace).Create(secret); err != nil {
+		t.Errorf("error when creating test secret")
+	}
+
+	object := getValidSSHExposure(t, string(secret.Data[DownstreamPublicKeyKey]))
+	d := newFakeDynamicClient(object)
+	handler := NewExposureHandler(c, d, mockRegistry{}, recorder, l)
+
+	ch := handler.NewCreateHandler()
+	ch.SetObject(object)
+
+	if err := ch.Handle(); err != nil {
+		t.Errorf("unexpected error when handling create event - %v", err)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, ReasonServiceNotFound) {
+		t.Errorf("expected %s event - got %v", ReasonServiceNotFound, event)
+	}
+
+	status := getExposureStatus(t, d)
+	if status.Registered || status.Reason != ReasonServiceNotFound {
+		t.Errorf("unexpected status - got %+v", status)
+	}
+
+	// an upstream registered before the service went away must not be left behind
+	expect := &registry.Upstream{Name: exposureUpstreamName(testNamespace, validExposureName)}
+	if upstream := <-resultChan; !reflect.DeepEqual(upstream, expect) {
+		t.Errorf("expected the exposure to be unregistered, expected \n %v \n but got \n%v", expect, upstream)
+	}
+}
+
+func TestSSHExposureHandlerResync(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	l, _ := zap.NewDevelopment()
+
+	secret, _, _ := getValidSSHSecret(t)
+	if _, err := c.CoreV1().Secrets(testNamespace).Create(secret); err != nil {
+		t.Errorf("error when creating test secret")
+	}
+	service, err := c.CoreV1().Services(testNamespace).Create(getValidSSHService(t))
+	if err != nil {
+		t.Errorf("error when creating test service")
+	}
+
+	d := newFakeDynamicClient(getValidSSHExposure(t, string(secret.Data[DownstreamPublicKeyKey])))
+	r := &recordingRegistry{}
+	handler := NewExposureHandler(c, d, r, record.NewFakeRecorder(10), l)
+	resync := func() {
+		t.Helper()
+		object, err := d.Resource(exposure.GroupVersionResource).Namespace(testNamespace).Get(validExposureName, metaV1.GetOptions{})
+		if err != nil {
+			t.Fatalf("error when getting test exposure - %v", err)
+		}
+		uh := handler.NewUpdateHandler()
+		uh.SetObjects(object, object)
+		if err = uh.Handle(); err != nil {
+			t.Errorf("unexpected error when handling resync - %v", err)
+		}
+	}
+
+	resync()
+	if len(r.registered) != 1 {
+		t.Fatalf("expected the exposure to be registered - got %v", r.registered)
+	}
+	resync()
+	if len(r.registered) != 1 {
+		t.Errorf("unexpected registration of an unchanged exposure - got %v", r.registered)
+	}
+
+	service.Spec.ClusterIP = "10.0.0.2"
+	if _, err = c.CoreV1().Services(testNamespace).Update(service); err != nil {
+		t.Errorf("error when updating test service")
+	}
+	resync()
+	if len(r.registered) != 2 || r.registered[1].Address != "10.0.0.2:22" {
+		t.Errorf("expected the exposure to be registered with the new address - got %v", r.registered)
+	}
+}
+
+func TestSSHExposureHandlerTrustedUserCAKeys(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	l, _ := zap.NewDevelopment()
+	recorder := record.NewFakeRecorder(10)
+
+	secret, _, _ := getValidSSHSecret(t)
+	if _, err := c.CoreV1().Secrets(testNamespace).Create(secret); err != nil {
+		t.Errorf("error when creating test secret")
+	}
+	if _, err := c.CoreV1().Services(testNamespace).Create(getValidSSHService(t)); err != nil {
+		t.Errorf("error when creating test service")
+	}
+
+	// any public key will do as a CA
+	ca := string(secret.Data[DownstreamPublicKeyKey])
+	object := getValidSSHExposure(t, "")
+	unstructured.RemoveNestedField(object.Object, "spec", "authorizedKeys")
+	if err := unstructured.SetNestedStringSlice(object.Object, []string{ca}, "spec", "trustedUserCAKeys"); err != nil {
+		t.Fatalf("failed to set trusted user CA keys - %v", err)
+	}
+	if err := unstructured.SetNestedStringSlice(object.Object, []string{"developers"}, "spec", "principals"); err != nil {
+		t.Fatalf("failed to set principals - %v", err)
+	}
+
+	handler := NewExposureHandler(c, newFakeDynamicClient(object), mockRegistry{}, recorder, l)
+	ch := handler.NewCreateHandler()
+	ch.SetObject(object)
+
+	if err := ch.Handle(); err != nil {
+		t.Errorf("unexpected error when handling create event - %v", err)
+	}
+
+	result := (<-resultChan).(*registry.Upstream)
+	if len(result.DownstreamPublicKey) != 0 || len(result.TrustedUserCAKeys) != 1 || !reflect.DeepEqual(result.Principals, []string{"developers"}) {
+		t.Errorf("unexpected upstream - got %+v", result)
+	}
+
+	<-recorder.Events
+	// the mock registry, like MySQL, only matches listed public keys
+	if event := <-recorder.Events; !strings.Contains(event, ReasonCertificatesUnsupported) {
+		t.Errorf("expected %s event - got %v", ReasonCertificatesUnsupported, event)
+	}
+}
+
+func TestSSHExposureHandlerUpdateStatusOnly(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	l, _ := zap.NewDevelopment()
+	recorder := record.NewFakeRecorder(10)
+	handler := NewExposureHandler(c, newFakeDynamicClient(), mockRegistry{}, recorder, l)
+
+	old := getValidSSHExposure(t, "")
+	old.SetResourceVersion("1")
+	new := old.DeepCopy()
+	new.SetResourceVersion("2")
+
+	uh := handler.NewUpdateHandler()
+	uh.SetObjects(old, new)
+
+	if err := uh.Handle(); err != nil {
+		t.Errorf("unexpected error when handling update event - %v", err)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("unexpected sync of an exposure whose generation did not change - got %v", <-recorder.Events)
+	}
+}
+
+func TestSSHExposureHandlerUpdateUsernameTaken(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	l, _ := zap.NewDevelopment()
+	recorder := record.NewFakeRecorder(10)
+
+	secret, _, _ := getValidSSHSecret(t)
+	if _, err := c.CoreV1().Secrets(testNamespace).Create(secret); err != nil {
+		t.Errorf("error when creating test secret")
+	}
+	if _, err := c.CoreV1().Services(testNamespace).Create(getValidSSHService(t)); err != nil {
+		t.Errorf("error when creating test service")
+	}
+
+	m := registry.NewMemory(l)
+	if _, err := m.RegisterUpstream(&registry.Upstream{Name: "other/app", Username: "bob", UpstreamUsername: "root", Address: "10.0.0.9:22"}); err != nil {
+		t.Fatalf("failed to register conflicting upstream - %v", err)
+	}
+
+	old := getValidSSHExposure(t, string(secret.Data[DownstreamPublicKeyKey]))
+	d := newFakeDynamicClient(old)
+	handler := NewExposureHandler(c, d, m, recorder, l)
+
+	ch := handler.NewCreateHandler()
+	ch.SetObject(old)
+	if err := ch.Handle(); err != nil {
+		t.Fatalf("unexpected error when handling create event - %v", err)
+	}
+	<-recorder.Events
+
+	new := old.DeepCopy()
+	new.SetResourceVersion("2")
+	new.SetGeneration(2)
+	if err := unstructured.SetNestedField(new.Object, "bob", "spec", "username"); err != nil {
+		t.Fatalf("failed to set username - %v", err)
+	}
+	uh := handler.NewUpdateHandler()
+	uh.SetObjects(old, new)
+	if err := uh.Handle(); err != nil {
+		t.Errorf("unexpected error when handling update event - %v", err)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, ReasonUsernameTaken) {
+		t.Errorf("expected %s event - got %v", ReasonUsernameTaken, event)
+	}
+
+	// the previous generation must not keep routing alice while the status says the exposure is not registered
+	if _, ok := m.Lookup("alice"); ok {
+		t.Errorf("expected the previous registration to be removed")
+	}
+	if u, ok := m.Lookup("bob"); !ok || u.Name != "other/app" {
+		t.Errorf("expected the conflicting upstream to be left alone - got %v", u)
+	}
+	status := getExposureStatus(t, d)
+	if status.Registered || status.Reason != ReasonUsernameTaken || status.Username != "" || status.ObservedGeneration != 2 {
+		t.Errorf("unexpected status - got %+v", status)
+	}
+}
+
+func TestSSHExposureHandlerDelete(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	l, _ := zap.NewDevelopment()
+	handler := NewExposureHandler(c, newFakeDynamicClient(), mockRegistry{}, record.NewFakeRecorder(10), l)
+
+	dh := handler.NewDeleteHandler()
+	dh.SetObject(getValidSSHExposure(t, ""))
+
+	if err := dh.Handle(); err != nil {
+		t.Errorf("unexpected error when handling delete event - %v", err)
+	}
+
+	upstream := <-resultChan
+	result, ok := upstream.(*registry.Upstream)
+	if !ok {
+		t.Errorf("unexpected type assertion - got %v", result)
+	}
+
+	expect := &registry.Upstream{
+		Name: exposureUpstreamName(testNamespace, validExposureName),
+	}
+
+	if !reflect.DeepEqual(result, expect) {
+		t.Errorf("unexpected result, expected \n %v \n but got \n%v", expect, result)
+	}
+}
+
+// getValidSSHExposure targets the valid service and secret, authorizing the given key
+func getValidSSHExposure(t *testing.T, authorizedKey string) *unstructured.Unstructured {
+	t.Helper()
+
+	e := &exposure.SSHExposure{
+		TypeMeta: metaV1.TypeMeta{
+			Kind:       exposure.Kind,
+			APIVersion: exposure.GroupVersionResource.GroupVersion().String(),
+		},
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:       validExposureName,
+			Namespace:  testNamespace,
+			Generation: 1,
+		},
+		Spec: exposure.Spec{
+			ServiceName:         validNames,
+			Username:            "alice",
+			AuthorizedKeys:      []string{authorizedKey},
+			PrivateKeySecretRef: exposure.SecretKeyRef{Name: validNames},
+		},
+	}
+
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(e)
+	if err != nil {
+		t.Fatalf("failed to convert test exposure - %v", err)
+	}
+	return &unstructured.Unstructured{Object: object}
+}
+
+func getExposureStatus(t *testing.T, d *dynamicFake.FakeDynamicClient) exposure.Status {
+	t.Helper()
+
+	object, err := d.Resource(exposure.GroupVersionResource).Namespace(testNamespace).Get(validExposureName, metaV1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error when getting test exposure - %v", err)
+	}
+	e, err := exposure.FromUnstructured(object)
+	if err != nil {
+		t.Fatalf("error when parsing test exposure - %v", err)
+	}
+	return e.Status
+}
+
+// newFakeDynamicClient registers the list kind the fake dynamic client asks its tracker for
+func newFakeDynamicClient(objects ...runtime.Object) *dynamicFake.FakeDynamicClient {
+	scheme := runtime.NewScheme()
+	scheme.AddKnownTypeWithName(schema.GroupVersionKind{Group: "fake-dynamic-client-group", Version: "v1", Kind: "List"}, &unstructured.UnstructuredList{})
+	return dynamicFake.NewSimpleDynamicClient(scheme, objects...)
+}
@@ -5,112 +5,174 @@ import (
 	"database/sql"
 	"encoding/base64"
 	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/exposure"
 	"github.com/EP4/kubernetes-ssh-container-exposer/internal/registry"
 	controller "github.com/philipgough/kube-kontroller"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 )
 
 const SSHServicePort int32 = 22
 
-var logger, _ = zap.NewDevelopment()
+// UsernameAnnotation and UsernameKey set the name users log in with through sshpiper, defaulting to the
+// username template
+const (
+	UsernameAnnotation = "ksce.io/username"
+	UsernameKey        = "username"
+)
+
+// UpstreamUsernameAnnotation and UpstreamUsernameKey set the user sshpiper logs in to the container as,
+// defaulting to the secret name
+const (
+	UpstreamUsernameAnnotation = "ksce.io/upstream-username"
+	UpstreamUsernameKey        = "upstream_username"
+)
+
+// PrincipalsAnnotation and PrincipalsKey list the comma separated principals accepted in user certificates,
+// defaulting to the username
+const (
+	PrincipalsAnnotation = "ksce.io/principals"
+	PrincipalsKey        = "principals"
+)
+
+// SSHPortName is the conventional name of the service port sshd is exposed on
+const SSHPortName = "ssh"
+
+// SSHPortAnnotation selects the service port sshd is exposed on by name or number
+const SSHPortAnnotation = "ksce.io/ssh-port"
+
+// ExposeLabel opts a Secret in to being registered as an SSH upstream
+const ExposeLabel = "ksce.io/expose"
+
+// ExposeLabelSelector is applied server side to the secret list/watch so unrelated secrets never reach the handlers
+var ExposeLabelSelector = labels.SelectorFromSet(labels.Set{ExposeLabel: "true"}).String()
+
+// NewSecretInformer lists and watches the exposed secrets in the namespace, where NamespaceAll covers the whole
+// cluster. Its cache answers the lookups of the service handler.
+func NewSecretInformer(c kubernetes.Interface, namespace string, resync time.Duration) coreinformers.SecretInformer {
+	factory := informers.NewSharedInformerFactoryWithOptions(c, resync,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(opts *metaV1.ListOptions) {
+			opts.LabelSelector = ExposeLabelSelector
+		}))
+	return factory.Core().V1().Secrets()
+}
 
 type (
 	Services []v1.Service
 	Keys     struct {
 		SSHPiperPrivateKey  string
 		DownstreamPublicKey []string
+		TrustedUserCAKeys   []string
+		UpstreamHostKeys    []string
 	}
 )
 
 type (
 	SSHSecretHandler struct {
-		client   kubernetes.Interface
-		registry registry.Registrable
-		logger   *zap.Logger
+		client     kubernetes.Interface
+		dependents *Dependents
+		registry   registry.Registrable
+		recorder   record.EventRecorder
+		logger     *zap.Logger
 	}
 
 	CreateResourceHandler struct {
-		client   kubernetes.Interface
-		registry registry.Registrable
-		logger   *zap.Logger
-		newValue interface{}
+		client     kubernetes.Interface
+		dependents *Dependents
+		registry   registry.Registrable
+		recorder   record.EventRecorder
+		logger     *zap.Logger
+		newValue   interface{}
 	}
 
 	UpdateResourceHandler struct {
-		client   kubernetes.Interface
-		registry registry.Registrable
-		logger   *zap.Logger
-		newValue interface{}
-		oldValue interface{}
+		client     kubernetes.Interface
+		dependents *Dependents
+		registry   registry.Registrable
+		recorder   record.EventRecorder
+		logger     *zap.Logger
+		newValue   interface{}
+		oldValue   interface{}
 	}
 
 	DeleteResourceHandler struct {
-		client   kubernetes.Interface
-		registry registry.Registrable
-		logger   *zap.Logger
-		oldValue interface{}
+		client     kubernetes.Interface
+		dependents *Dependents
+		registry   registry.Registrable
+		recorder   record.EventRecorder
+		logger     *zap.Logger
+		oldValue   interface{}
 	}
 )
 
-func NewSecretHandler(c kubernetes.Interface, r registry.Registrable, l *zap.Logger) SSHSecretHandler {
+// NewSecretHandler registers exposed secrets with their service, syncing the SSHExposures which take their private
+// key from the secret through d
+func NewSecretHandler(c kubernetes.Interface, d *Dependents, r registry.Registrable, rec record.EventRecorder, l *zap.Logger) SSHSecretHandler {
 	return SSHSecretHandler{
-		client:   c,
-		registry: r,
-		logger:   l,
+		client:     c,
+		dependents: d,
+		registry:   r,
+		recorder:   rec,
+		logger:     l,
 	}
 }
 
 func (h SSHSecretHandler) NewCreateHandler() controller.HandleCreate {
 	return &CreateResourceHandler{
-		client:   h.client,
-		registry: h.registry,
-		logger:   h.logger,
+		client:     h.client,
+		dependents: h.dependents,
+		registry:   h.registry,
+		recorder:   h.recorder,
+		logger:     h.logger,
 	}
 }
 
 func (h SSHSecretHandler) NewUpdateHandler() controller.HandleUpdate {
 	return &UpdateResourceHandler{
-		client:   h.client,
-		registry: h.registry,
-		logger:   h.logger,
+		client:     h.client,
+		dependents: h.dependents,
+		registry:   h.registry,
+		recorder:   h.recorder,
+		logger:     h.logger,
 	}
 }
 
 func (h SSHSecretHandler) NewDeleteHandler() controller.HandleDelete {
 	return &DeleteResourceHandler{
-		client:   h.client,
-		registry: h.registry,
-		logger:   h.logger,
+		client:     h.client,
+		dependents: h.dependents,
+		registry:   h.registry,
+		recorder:   h.recorder,
+		logger:     h.logger,
 	}
 }
 
 func (ch *CreateResourceHandler) Handle() error {
+	return observe(resourceSecret, eventCreate, ch.handle)
+}
+
+func (ch *CreateResourceHandler) handle() error {
 	secret, ok := ch.newValue.(*v1.Secret)
 	if !ok {
 		return handleTypeAssertionError(ch.logger, ch.newValue)
 	}
-
-	service, err := getSSHService(secret.Name, secret.Namespace, ch.client)
-	if err != nil || service == nil {
-		// //TODO - add logging - this is likely not worth retrying but might want to add some relevant logging
-		return nil
-	}
-
-	u, err := getUpstreamFromSecret(secret)
-	if err != nil {
-		// its debatable if we should actually retry this work here again
-		// might be worth invalidating specific secrets and services
-		// TODO - add logging
-		return nil
-	}
-
-	u.Address = service.Spec.ClusterIP
-	return registerUpstream(ch.registry, u)
+	ch.dependents.sync(exposure.SecretIndex, secret.Namespace, secret.Name)
+	return syncSecretWithService(secret, ch.client, ch.registry, ch.recorder, ch.logger)
 }
 
 func (ch *CreateResourceHandler) SetObject(object interface{}) {
@@ -118,6 +180,10 @@ func (ch *CreateResourceHandler) SetObject(object interface{}) {
 }
 
 func (uh *UpdateResourceHandler) Handle() error {
+	return observe(resourceSecret, eventUpdate, uh.handle)
+}
+
+func (uh *UpdateResourceHandler) handle() error {
 	old, ok := uh.oldValue.(*v1.Secret)
 	if !ok {
 		return handleTypeAssertionError(uh.logger, uh.oldValue)
@@ -128,27 +194,12 @@ func (uh *UpdateResourceHandler) Handle() error {
 		return handleTypeAssertionError(uh.logger, uh.newValue)
 	}
 
-	if old.ResourceVersion != new.ResourceVersion {
-		service, err := getSSHService(new.Name, new.Namespace, uh.client)
-		if err != nil || service == nil {
-			// this is likely not worth retrying but might want to add some relevant logging
-			return nil
-		}
-
-		u, err := getUpstreamFromSecret(new)
-		if err != nil {
-			// its debatable if we should actually retry this work here again
-			// might be worth invalidating specific secrets and services
-			// TODO - add logging
-			return nil
-		}
-
-		u.Address = service.Spec.ClusterIP
-		return registerUpstream(uh.registry, u)
-	} else {
-		// nothing to do
-		return nil
+	if old.ResourceVersion == new.ResourceVersion || !secretChanged(old, new) {
+		// nothing to do, including when only our own status annotations were written
+		return skipped(skipUnchanged)
 	}
+	uh.dependents.sync(exposure.SecretIndex, new.Namespace, new.Name)
+	return syncSecretWithService(new, uh.client, uh.registry, uh.recorder, uh.logger)
 }
 
 func (uh *UpdateResourceHandler) SetObjects(old, new interface{}) {
@@ -157,23 +208,29 @@ func (uh *UpdateResourceHandler) SetObjects(old, new interface{}) {
 }
 
 func (dh *DeleteResourceHandler) Handle() error {
+	return observe(resourceSecret, eventDelete, dh.handle)
+}
+
+func (dh *DeleteResourceHandler) handle() error {
 	secret, ok := dh.oldValue.(*v1.Secret)
 	if !ok {
 		return handleTypeAssertionError(dh.logger, dh.oldValue)
 	}
+	dh.dependents.sync(exposure.SecretIndex, secret.Namespace, secret.Name)
 	u, err := getUpstreamFromSecret(secret)
 	if err != nil {
-		// its debatable if we should actually retry this work here again
-		// might be worth invalidating specific secrets and services
-		// TODO - add logging
-		return nil
+		// the secret may have become invalid after it was registered, its name is all that is needed to clean up
+		u = &registry.Upstream{Name: upstreamName(secret.Namespace, secret.Name)}
 	}
 	err = dh.registry.UnregisterUpstream(u)
 	switch err {
-	case sql.ErrNoRows:
-		// TODO - add logging - continuing here is futile since we have hit a case where we are going to be unable
-		// to clean up from - log it and move on
+	case nil:
+		dh.logger.Info("Secret removed", zap.String("name", secret.Name), zap.String("namespace", secret.Namespace))
 		return nil
+	case sql.ErrNoRows:
+		// continuing here is futile since we have hit a case where we are going to be unable to clean up from
+		dh.logger.Debug("no upstream to unregister for secret", zap.String("name", secret.Name), zap.String("namespace", secret.Namespace))
+		return skipped(skipNotRegistered)
 	default:
 		// potentially a transient error so retries within the limits are worth doing
 		return err
@@ -186,6 +243,39 @@ func (dh *DeleteResourceHandler) SetObject(object interface{}) {
 
 //// utility functions to be used by handlers ///////
 
+// syncSecretWithService registers the secret once its service exists and exposes a usable port
+func syncSecretWithService(secret *v1.Secret, client kubernetes.Interface, r registry.Registrable, rec record.EventRecorder, l *zap.Logger) error {
+	service, err := getSSHService(secret.Name, secret.Namespace, client)
+	if err != nil && !errors.IsNotFound(err) {
+		// transient api errors are worth retrying
+		return err
+	}
+	if service == nil {
+		// the service handler will register the upstream once the service appears
+		rec.Eventf(secret, v1.EventTypeWarning, ReasonServiceNotFound, "no service %s with a usable ssh port", secret.Name)
+		return skipped(ReasonServiceNotFound)
+	}
+	return syncSecret(secret, service, client, r, rec, l)
+}
+
+// secretChanged compares the parts of the secret which affect registration, ignoring status annotations
+func secretChanged(old, new *v1.Secret) bool {
+	withoutStatus := func(annotations map[string]string) map[string]string {
+		filtered := make(map[string]string, len(annotations))
+		for k, v := range annotations {
+			filtered[k] = v
+		}
+		for _, k := range statusAnnotations {
+			delete(filtered, k)
+		}
+		return filtered
+	}
+
+	return !reflect.DeepEqual(old.Data, new.Data) ||
+		!reflect.DeepEqual(old.Labels, new.Labels) ||
+		!reflect.DeepEqual(withoutStatus(old.Annotations), withoutStatus(new.Annotations))
+}
+
 func hasPort(servicePorts []v1.ServicePort, port int32) bool {
 	for _, servicePort := range servicePorts {
 		if servicePort.Port == port {
@@ -195,30 +285,116 @@ func hasPort(servicePorts []v1.ServicePort, port int32) bool {
 	return false
 }
 
+// sshPort picks the port sshpiper should dial on the service, preferring the port selected by annotation,
+// then the port named ssh and finally the default ssh port
+func sshPort(service *v1.Service) (int32, bool) {
+	return selectSSHPort(service, service.Annotations[SSHPortAnnotation])
+}
+
+// selectSSHPort finds the selected port by name or number, falling back to the port named ssh and then the
+// default ssh port when nothing is selected
+func selectSSHPort(service *v1.Service, selected string) (int32, bool) {
+	if selected != "" {
+		for _, servicePort := range service.Spec.Ports {
+			if servicePort.Name == selected || strconv.Itoa(int(servicePort.Port)) == selected {
+				return servicePort.Port, true
+			}
+		}
+		return 0, false
+	}
+
+	for _, servicePort := range service.Spec.Ports {
+		if servicePort.Name == SSHPortName {
+			return servicePort.Port, true
+		}
+	}
+
+	if hasPort(service.Spec.Ports, SSHServicePort) {
+		return SSHServicePort, true
+	}
+	return 0, false
+}
+
+// isRoutable reports whether the service has a cluster IP and a usable ssh port
+func isRoutable(service *v1.Service) bool {
+	_, ok := sshPort(service)
+	return hasClusterIP(service) && ok
+}
+
+func hasClusterIP(service *v1.Service) bool {
+	return service.Spec.ClusterIP != "" && service.Spec.ClusterIP != v1.ClusterIPNone
+}
+
+// sshAddress of the service in host:port form, only meaningful for routable services
+func sshAddress(service *v1.Service) string {
+	port, _ := sshPort(service)
+	return serviceAddress(service, port)
+}
+
+func serviceAddress(service *v1.Service, port int32) string {
+	return net.JoinHostPort(service.Spec.ClusterIP, strconv.Itoa(int(port)))
+}
+
 func parseSecretKeys(secret *v1.Secret) (Keys, error) {
-	var downstreamPublicKeys []string
-	secretDownstreamPublicKeys := bytes.Split(secret.Data["downstream_id_rsa.pub"], []byte("\n"))
+	downstreamPublicKeys, err := parseAuthorizedKeys(secretData(secret, DownstreamPublicKeyKey, LegacyDownstreamPublicKeyKey))
+	if err != nil {
+		return Keys{}, err
+	}
+	trustedUserCAKeys, err := parseKeys(secret.Data[TrustedUserCAKeysKey], "trusted user CA key")
+	if err != nil {
+		return Keys{}, err
+	}
+	upstreamHostKeys, err := parseKeys(secret.Data[UpstreamHostKeysKey], "upstream host key")
+	if err != nil {
+		return Keys{}, err
+	}
+	// a missing key is generated by the handlers before the secret is registered
+	if _, err = parseSSHPiperKey(sshPiperKey(secret)); err != nil {
+		return Keys{}, err
+	}
+	return Keys{
+		SSHPiperPrivateKey:  string(sshPiperKey(secret)),
+		DownstreamPublicKey: downstreamPublicKeys,
+		TrustedUserCAKeys:   trustedUserCAKeys,
+		UpstreamHostKeys:    upstreamHostKeys,
+	}, nil
+}
+
+// parseAuthorizedKeys in authorized_keys format into the base64 wire format sshpiper stores
+func parseAuthorizedKeys(authorizedKeys []byte) ([]string, error) {
+	return parseKeys(authorizedKeys, "downstream public key")
+}
 
-	for _, downstreamPublicKey := range secretDownstreamPublicKeys {
+// parseKeys in authorized_keys format, describing the keys as what in errors. A key listed more than once, for
+// example with different comments or options, is only returned once.
+func parseKeys(authorizedKeys []byte, what string) ([]string, error) {
+	var downstreamPublicKeys []string
+	seen := make(map[string]bool)
+	for _, downstreamPublicKey := range bytes.Split(authorizedKeys, []byte("\n")) {
 		if string(downstreamPublicKey) == "" {
 			continue
 		}
 		byteDownstreamPublicKey, _, _, _, err := ssh.ParseAuthorizedKey(downstreamPublicKey)
 		if err != nil {
-			return Keys{}, err
-		} else {
-			downstreamPublicKeys = append(downstreamPublicKeys, base64.StdEncoding.EncodeToString(byteDownstreamPublicKey.Marshal()))
+			return nil, syncError{reason: ReasonInvalidPublicKey, err: fmt.Errorf("invalid %s - %v", what, err)}
 		}
-
+		key := base64.StdEncoding.EncodeToString(byteDownstreamPublicKey.Marshal())
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		downstreamPublicKeys = append(downstreamPublicKeys, key)
 	}
-	return Keys{
-		SSHPiperPrivateKey:  string(secret.Data["sshpiper_id_rsa"]),
-		DownstreamPublicKey: downstreamPublicKeys,
-	}, nil
+	return downstreamPublicKeys, nil
 }
 
-func registerUpstream(r registry.Registrable, upstream *registry.Upstream) error {
+func registerUpstream(r registry.Registrable, upstream *registry.Upstream, l *zap.Logger) error {
 	_, err := r.RegisterUpstream(upstream)
+	if err == registry.ErrUsernameTaken {
+		// retrying will not help until one of the conflicting secrets changes
+		l.Error("username is already in use", zap.String("name", upstream.Name), zap.String("username", upstream.Username))
+		return nil
+	}
 	return err
 }
 
@@ -229,27 +405,61 @@ func getSSHService(name, namespace string, client kubernetes.Interface) (*v1.Ser
 		return nil, err
 	}
 
-	//if !hasPort(service.Spec.Ports, SSHServicePort) {
-	//	return nil, nil
-	//}
+	if !isRoutable(service) {
+		return nil, nil
+	}
 	return service, nil
 }
 
+// secretSetting reads an optional setting from the secret annotation, then the data key, before falling back
+func secretSetting(s *v1.Secret, annotation, key, fallback string) string {
+	if value := strings.TrimSpace(s.Annotations[annotation]); value != "" {
+		return value
+	}
+	if value := strings.TrimSpace(string(s.Data[key])); value != "" {
+		return value
+	}
+	return fallback
+}
+
 func getUpstreamFromSecret(s *v1.Secret) (*registry.Upstream, error) {
 	keys, err := parseSecretKeys(s)
 	if err != nil {
 		return nil, err
 	}
 
+	username, err := defaultUsername(s.Namespace, s.Name)
+	if err != nil {
+		return nil, syncError{reason: ReasonInvalidSecret, err: err}
+	}
+
 	upstream := &registry.Upstream{
-		Name:                s.Name,
-		Username:            s.Name,
+		Name:                upstreamName(s.Namespace, s.Name),
+		Username:            secretSetting(s, UsernameAnnotation, UsernameKey, username),
+		UpstreamUsername:    secretSetting(s, UpstreamUsernameAnnotation, UpstreamUsernameKey, s.Name),
 		SSHPiperPrivateKey:  keys.SSHPiperPrivateKey,
 		DownstreamPublicKey: keys.DownstreamPublicKey,
+		TrustedUserCAKeys:   keys.TrustedUserCAKeys,
+		Principals:          splitPrincipals(secretSetting(s, PrincipalsAnnotation, PrincipalsKey, "")),
+		UpstreamHostKeys:    keys.UpstreamHostKeys,
+	}
+	if err = upstream.Validate(); err != nil {
+		return nil, syncError{reason: ReasonInvalidSecret, err: err}
 	}
 	return upstream, nil
 }
 
+// splitPrincipals from a comma separated list
+func splitPrincipals(list string) []string {
+	var principals []string
+	for _, principal := range strings.Split(list, ",") {
+		if principal = strings.TrimSpace(principal); principal != "" {
+			principals = append(principals, principal)
+		}
+	}
+	return principals
+}
+
 func handleTypeAssertionError(l *zap.Logger, args ...interface{}) error {
 	err := fmt.Errorf("error when asserting type of Secret got %v", args)
 	l.Sugar().Error(err.Error())
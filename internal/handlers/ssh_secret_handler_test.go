@@ -1,31 +1,42 @@
 package handlers
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/EP4/kubernetes-ssh-container-exposer/internal/registry"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/ed25519"
 	"golang.org/x/crypto/ssh"
 	v1 "k8s.io/api/core/v1"
 	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
 )
 
 const testNamespace = "test"
 const validNames = "test-ssh"
+const validUpstreamName = testNamespace + "/" + validNames
 const staticClusterIP = "127.0.0.1"
+const staticAddress = "127.0.0.1:22"
 
 var resultChan = make(chan interface{})
 
 func TestSSHSecretHandlerCreate(t *testing.T) {
 	c := fake.NewSimpleClientset()
 	l, _ := zap.NewDevelopment()
-	handler := NewSecretHandler(c, mockRegistry{}, l)
+	handler := NewSecretHandler(c, nil, mockRegistry{}, record.NewFakeRecorder(10), l)
 
 	ch := handler.NewCreateHandler()
 
@@ -56,9 +67,10 @@ func TestSSHSecretHandlerCreate(t *testing.T) {
 	}
 
 	expect := &registry.Upstream{
-		Name:                validNames,
+		Name:                validUpstreamName,
 		Username:            validNames,
-		Address:             staticClusterIP,
+		UpstreamUsername:    validNames,
+		Address:             staticAddress,
 		SSHPiperPrivateKey:  s,
 		DownstreamPublicKey: b64,
 	}
@@ -71,7 +83,7 @@ func TestSSHSecretHandlerCreate(t *testing.T) {
 func TestSSHSecretHandlerUpdate(t *testing.T) {
 	c := fake.NewSimpleClientset()
 	l, _ := zap.NewDevelopment()
-	handler := NewSecretHandler(c, mockRegistry{}, l)
+	handler := NewSecretHandler(c, nil, mockRegistry{}, record.NewFakeRecorder(10), l)
 
 	uh := handler.NewUpdateHandler()
 
@@ -90,9 +102,7 @@ func TestSSHSecretHandlerUpdate(t *testing.T) {
 	// mimic the behaviour guaranteed by our controller when a create method is called
 	copy := secret.DeepCopy()
 	copy.ResourceVersion = "2"
-	copy.StringData = map[string]string{
-		"test": "update",
-	}
+	copy.Data["test"] = []byte("update")
 	_, err = c.CoreV1().Secrets(testNamespace).Update(copy)
 	if err != nil {
 		t.Errorf("error when creating test secret")
@@ -111,9 +121,10 @@ func TestSSHSecretHandlerUpdate(t *testing.T) {
 	}
 
 	expect := &registry.Upstream{
-		Name:                validNames,
+		Name:                validUpstreamName,
 		Username:            validNames,
-		Address:             staticClusterIP,
+		UpstreamUsername:    validNames,
+		Address:             staticAddress,
 		SSHPiperPrivateKey:  s,
 		DownstreamPublicKey: b64,
 	}
@@ -123,10 +134,210 @@ func TestSSHSecretHandlerUpdate(t *testing.T) {
 	}
 }
 
+func TestSSHSecretHandlerUpdateStatusOnly(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	l, _ := zap.NewDevelopment()
+	handler := NewSecretHandler(c, nil, mockRegistry{}, record.NewFakeRecorder(10), l)
+
+	uh := handler.NewUpdateHandler()
+
+	secret, _, _ := getValidSSHSecret(t)
+	copy := secret.DeepCopy()
+	copy.ResourceVersion = "2"
+	copy.Annotations = map[string]string{
+		LastSyncedAnnotation:         "2019-01-01T00:00:00Z",
+		RegisteredUsernameAnnotation: validNames,
+	}
+	uh.SetObjects(secret, copy)
+
+	err := uh.Handle()
+	if err != nil {
+		t.Errorf("unexpected error when handling update event - %v", err)
+	}
+
+	select {
+	case upstream := <-resultChan:
+		t.Errorf("unexpected registration when only status annotations changed - got %v", upstream)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSSHSecretHandlerEvents(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	l, _ := zap.NewDevelopment()
+	recorder := record.NewFakeRecorder(10)
+	handler := NewSecretHandler(c, nil, mockRegistry{}, recorder, l)
+
+	ch := handler.NewCreateHandler()
+
+	secret, _, _ := getValidSSHSecret(t)
+	secret, err := c.CoreV1().Secrets(testNamespace).Create(secret)
+	if err != nil {
+		t.Errorf("error when creating test secret")
+	}
+
+	ch.SetObject(secret)
+	if err = ch.Handle(); err != nil {
+		t.Errorf("unexpected error when handling create event - %v", err)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, ReasonServiceNotFound) {
+		t.Errorf("expected %s event - got %v", ReasonServiceNotFound, event)
+	}
+
+	_, err = c.CoreV1().Services(testNamespace).Create(getValidSSHService(t))
+	if err != nil {
+		t.Errorf("error when creating test service")
+	}
+
+	if err = ch.Handle(); err != nil {
+		t.Errorf("unexpected error when handling create event - %v", err)
+	}
+	<-resultChan
+	// registration is recorded against both the secret and the service
+	for i := 0; i < 2; i++ {
+		if event := <-recorder.Events; !strings.Contains(event, ReasonRegistered) {
+			t.Errorf("expected %s event - got %v", ReasonRegistered, event)
+		}
+	}
+
+	annotated, err := c.CoreV1().Secrets(testNamespace).Get(validNames, metaV1.GetOptions{})
+	if err != nil {
+		t.Errorf("error when getting test secret")
+	}
+	if annotated.Annotations[RegisteredUsernameAnnotation] != validNames || annotated.Annotations[LastSyncedAnnotation] == "" {
+		t.Errorf("expected status annotations on the secret - got %v", annotated.Annotations)
+	}
+
+	secret.Data[DownstreamPublicKeyKey] = []byte("not a key")
+	if err = ch.Handle(); err != nil {
+		t.Errorf("unexpected error when handling create event - %v", err)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, ReasonInvalidPublicKey) {
+		t.Errorf("expected %s event - got %v", ReasonInvalidPublicKey, event)
+	}
+}
+
+func TestSSHSecretHandlerGeneratesKey(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	l, _ := zap.NewDevelopment()
+	handler := NewSecretHandler(c, nil, mockRegistry{}, record.NewFakeRecorder(10), l)
+
+	ch := handler.NewCreateHandler()
+
+	secret, _, _ := getValidSSHSecret(t)
+	delete(secret.Data, SSHPiperPrivateKeyKey)
+	secret, err := c.CoreV1().Secrets(testNamespace).Create(secret)
+	if err != nil {
+		t.Errorf("error when creating test secret")
+	}
+	if _, err = c.CoreV1().Services(testNamespace).Create(getValidSSHService(t)); err != nil {
+		t.Errorf("error when creating test service")
+	}
+
+	ch.SetObject(secret)
+	if err = ch.Handle(); err != nil {
+		t.Errorf("unexpected error when handling create event - %v", err)
+	}
+
+	result := (<-resultChan).(*registry.Upstream)
+	signer, err := ssh.ParsePrivateKey([]byte(result.SSHPiperPrivateKey))
+	if err != nil {
+		t.Fatalf("expected a generated private key to be registered - %v", err)
+	}
+
+	stored, err := c.CoreV1().Secrets(testNamespace).Get(validNames, metaV1.GetOptions{})
+	if err != nil {
+		t.Errorf("error when getting test secret")
+	}
+	if string(stored.Data[SSHPiperPrivateKeyKey]) != result.SSHPiperPrivateKey {
+		t.Errorf("expected the generated key to be stored in the secret")
+	}
+
+	companion, err := c.CoreV1().Secrets(testNamespace).Get(validNames+PublicKeySecretSuffix, metaV1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected companion secret to be created - %v", err)
+	}
+	if !bytes.Equal(companion.Data[AuthorizedKeysKey], ssh.MarshalAuthorizedKey(signer.PublicKey())) {
+		t.Errorf("unexpected authorized_keys in companion secret - got %s", companion.Data[AuthorizedKeysKey])
+	}
+	if !metaV1.IsControlledBy(companion, stored) {
+		t.Errorf("expected companion secret to be owned by the exposed secret - got %v", companion.OwnerReferences)
+	}
+}
+
+func TestGetUpstreamFromSecretKeyAlgorithms(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ecdsa key - %v", err)
+	}
+	ecdsaDER, err := x509.MarshalECPrivateKey(ecdsaKey)
+	if err != nil {
+		t.Fatalf("failed to marshal ecdsa key - %v", err)
+	}
+	ecdsaPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecdsaDER})
+
+	ed25519Public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ed25519 key - %v", err)
+	}
+	ed25519Key, err := ssh.NewPublicKey(ed25519Public)
+	if err != nil {
+		t.Fatalf("failed to convert ed25519 key - %v", err)
+	}
+
+	tests := []struct {
+		name string
+		data map[string][]byte
+	}{
+		{
+			name: "current data keys",
+			data: map[string][]byte{SSHPiperPrivateKeyKey: ecdsaPEM, DownstreamPublicKeyKey: ssh.MarshalAuthorizedKey(ed25519Key)},
+		},
+		{
+			name: "legacy data keys",
+			data: map[string][]byte{LegacySSHPiperPrivateKeyKey: ecdsaPEM, LegacyDownstreamPublicKeyKey: ssh.MarshalAuthorizedKey(ed25519Key)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret, _, _ := getValidSSHSecret(t)
+			secret.Data = tt.data
+
+			u, err := getUpstreamFromSecret(secret)
+			if err != nil {
+				t.Fatalf("unexpected error - %v", err)
+			}
+			if u.SSHPiperPrivateKey != string(ecdsaPEM) {
+				t.Errorf("expected the ecdsa key to be registered")
+			}
+			expect := []string{base64.StdEncoding.EncodeToString(ed25519Key.Marshal())}
+			if !reflect.DeepEqual(u.DownstreamPublicKey, expect) {
+				t.Errorf("unexpected public keys, expected %v but got %v", expect, u.DownstreamPublicKey)
+			}
+		})
+	}
+}
+
+func TestParseAuthorizedKeysDuplicates(t *testing.T) {
+	pk, key, _ := generateKey(t)
+	authorizedKey := strings.TrimSpace(string(key))
+	authorizedKeys := authorizedKey + " alice@laptop\n" + authorizedKey + " alice@desktop\n"
+
+	keys, err := parseAuthorizedKeys([]byte(authorizedKeys))
+	if err != nil {
+		t.Fatalf("unexpected error - %v", err)
+	}
+	expect := []string{base64.StdEncoding.EncodeToString(pk.Marshal())}
+	if !reflect.DeepEqual(keys, expect) {
+		t.Errorf("expected the duplicated key once, expected %v but got %v", expect, keys)
+	}
+}
+
 func TestSSHSecretHandlerDelete(t *testing.T) {
 	c := fake.NewSimpleClientset()
 	l, _ := zap.NewDevelopment()
-	handler := NewSecretHandler(c, mockRegistry{}, l)
+	handler := NewSecretHandler(c, nil, mockRegistry{}, record.NewFakeRecorder(10), l)
 
 	secret, s, b64 := getValidSSHSecret(t)
 	dh := handler.NewDeleteHandler()
@@ -144,8 +355,9 @@ func TestSSHSecretHandlerDelete(t *testing.T) {
 	}
 
 	expect := &registry.Upstream{
-		Name:                validNames,
+		Name:                validUpstreamName,
 		Username:            validNames,
+		UpstreamUsername:    validNames,
 		SSHPiperPrivateKey:  s,
 		DownstreamPublicKey: b64,
 	}
@@ -155,11 +367,151 @@ func TestSSHSecretHandlerDelete(t *testing.T) {
 	}
 }
 
+func TestGetUpstreamFromSecretUsernames(t *testing.T) {
+	tests := []struct {
+		name             string
+		annotations      map[string]string
+		data             map[string]string
+		username         string
+		upstreamUsername string
+		invalid          bool
+	}{
+		{
+			name:             "defaults to secret name",
+			username:         validNames,
+			upstreamUsername: validNames,
+		},
+		{
+			name:             "annotations",
+			annotations:      map[string]string{UsernameAnnotation: "alice", UpstreamUsernameAnnotation: "root"},
+			username:         "alice",
+			upstreamUsername: "root",
+		},
+		{
+			name:             "data keys",
+			data:             map[string]string{UsernameKey: "bob\n", UpstreamUsernameKey: "dev"},
+			username:         "bob",
+			upstreamUsername: "dev",
+		},
+		{
+			name:             "annotations take precedence",
+			annotations:      map[string]string{UsernameAnnotation: "alice"},
+			data:             map[string]string{UsernameKey: "bob"},
+			username:         "alice",
+			upstreamUsername: validNames,
+		},
+		{
+			name:        "too long",
+			annotations: map[string]string{UsernameAnnotation: strings.Repeat("a", 46)},
+			invalid:     true,
+		},
+		{
+			name:        "invalid characters",
+			annotations: map[string]string{UpstreamUsernameAnnotation: "root user"},
+			invalid:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret, _, _ := getValidSSHSecret(t)
+			secret.Annotations = tt.annotations
+			for k, v := range tt.data {
+				secret.Data[k] = []byte(v)
+			}
+
+			u, err := getUpstreamFromSecret(secret)
+			if tt.invalid {
+				if err == nil {
+					t.Errorf("expected validation error - got %v", u)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error - %v", err)
+			}
+			if u.Username != tt.username || u.UpstreamUsername != tt.upstreamUsername {
+				t.Errorf("unexpected usernames, expected %s/%s but got %s/%s", tt.username, tt.upstreamUsername, u.Username, u.UpstreamUsername)
+			}
+		})
+	}
+}
+
+func TestSSHAddress(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		ports       []v1.ServicePort
+		clusterIP   string
+		expect      string
+		routable    bool
+	}{
+		{
+			name:     "default port",
+			ports:    []v1.ServicePort{{Name: "http", Port: 80}, {Port: SSHServicePort}},
+			expect:   "127.0.0.1:22",
+			routable: true,
+		},
+		{
+			name:     "port named ssh",
+			ports:    []v1.ServicePort{{Name: SSHPortName, Port: 2222}, {Port: SSHServicePort}},
+			expect:   "127.0.0.1:2222",
+			routable: true,
+		},
+		{
+			name:        "annotation by name",
+			annotations: map[string]string{SSHPortAnnotation: "sshd"},
+			ports:       []v1.ServicePort{{Name: SSHPortName, Port: 22}, {Name: "sshd", Port: 2022}},
+			expect:      "127.0.0.1:2022",
+			routable:    true,
+		},
+		{
+			name:        "annotation by number",
+			annotations: map[string]string{SSHPortAnnotation: "2022"},
+			ports:       []v1.ServicePort{{Name: "http", Port: 80}, {Port: 2022}},
+			expect:      "127.0.0.1:2022",
+			routable:    true,
+		},
+		{
+			name:        "annotation without matching port",
+			annotations: map[string]string{SSHPortAnnotation: "2022"},
+			ports:       []v1.ServicePort{{Port: SSHServicePort}},
+		},
+		{
+			name:  "no usable port",
+			ports: []v1.ServicePort{{Name: "http", Port: 80}},
+		},
+		{
+			name:      "headless service",
+			ports:     []v1.ServicePort{{Port: SSHServicePort}},
+			clusterIP: v1.ClusterIPNone,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := getValidSSHService(t)
+			service.Annotations = tt.annotations
+			service.Spec.Ports = tt.ports
+			if tt.clusterIP != "" {
+				service.Spec.ClusterIP = tt.clusterIP
+			}
+
+			if routable := isRoutable(service); routable != tt.routable {
+				t.Fatalf("unexpected routable, expected %v but got %v", tt.routable, routable)
+			}
+			if tt.routable && sshAddress(service) != tt.expect {
+				t.Errorf("unexpected address, expected %v but got %v", tt.expect, sshAddress(service))
+			}
+		})
+	}
+}
+
 // getValidSSHSecret expected to be parsed during happy path test
 func getValidSSHSecret(t *testing.T) (*v1.Secret, string, []string) {
 	t.Helper()
 
-	pk, key := generatePublicKey(t)
+	pk, key, privateKey := generateKey(t)
 
 	secret := &v1.Secret{
 		TypeMeta: metaV1.TypeMeta{
@@ -167,18 +519,23 @@ func getValidSSHSecret(t *testing.T) (*v1.Secret, string, []string) {
 			APIVersion: "v1",
 		},
 		ObjectMeta: metaV1.ObjectMeta{
-			Name: validNames,
+			Name:      validNames,
+			Namespace: testNamespace,
+			Labels: map[string]string{
+				ExposeLabel: "true",
+			},
 		},
 		Data: map[string][]byte{
-			"sshpiper_id_rsa":       key,
-			"downstream_id_rsa.pub": key,
+			SSHPiperPrivateKeyKey:  privateKey,
+			DownstreamPublicKeyKey: key,
 		},
 	}
 
-	return secret, string(key), []string{base64.StdEncoding.EncodeToString(pk.Marshal())}
+	return secret, string(privateKey), []string{base64.StdEncoding.EncodeToString(pk.Marshal())}
 }
 
-func generatePublicKey(t *testing.T) (ssh.PublicKey, []byte) {
+// generateKey returns the public key, its authorized_keys form and the private key in PEM form
+func generateKey(t *testing.T) (ssh.PublicKey, []byte, []byte) {
 	t.Helper()
 	bitSize := 4096
 
@@ -201,7 +558,8 @@ func generatePublicKey(t *testing.T) (ssh.PublicKey, []byte) {
 	if err != nil {
 		t.Errorf("failed to parse authorized key")
 	}
-	return pk, parseable
+	privatePEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	return pk, parseable, privatePEM
 }
 
 func getValidSSHService(t *testing.T) *v1.Service {
@@ -211,7 +569,8 @@ func getValidSSHService(t *testing.T) *v1.Service {
 			Kind: "service",
 		},
 		ObjectMeta: metaV1.ObjectMeta{
-			Name: validNames,
+			Name:      validNames,
+			Namespace: testNamespace,
 		},
 		Spec: v1.ServiceSpec{
 			Ports: []v1.ServicePort{
@@ -241,3 +600,7 @@ func (mr mockRegistry) UnregisterUpstream(upstream *registry.Upstream) error {
 	go func() { resultChan <- upstream }()
 	return nil
 }
+
+func (mr mockRegistry) ListUpstreams() ([]*registry.Upstream, error) {
+	return nil, nil
+}
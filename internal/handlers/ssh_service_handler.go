@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"database/sql"
+
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/exposure"
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/registry"
+	controller "github.com/philipgough/kube-kontroller"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+type (
+	SSHServiceHandler struct {
+		client     kubernetes.Interface
+		secrets    corelisters.SecretLister
+		dependents *Dependents
+		registry   registry.Registrable
+		recorder   record.EventRecorder
+		logger     *zap.Logger
+	}
+
+	CreateServiceHandler struct {
+		client     kubernetes.Interface
+		secrets    corelisters.SecretLister
+		dependents *Dependents
+		registry   registry.Registrable
+		recorder   record.EventRecorder
+		logger     *zap.Logger
+		newValue   interface{}
+	}
+
+	UpdateServiceHandler struct {
+		client     kubernetes.Interface
+		secrets    corelisters.SecretLister
+		dependents *Dependents
+		registry   registry.Registrable
+		recorder   record.EventRecorder
+		logger     *zap.Logger
+		newValue   interface{}
+		oldValue   interface{}
+	}
+
+	DeleteServiceHandler struct {
+		client     kubernetes.Interface
+		secrets    corelisters.SecretLister
+		dependents *Dependents
+		registry   registry.Registrable
+		recorder   record.EventRecorder
+		logger     *zap.Logger
+		oldValue   interface{}
+	}
+)
+
+// NewServiceHandler watches the Service side of a Secret/Service pair so that an upstream is registered
+// regardless of which of the two objects is created first. Secrets are looked up in the cache of the exposed secret
+// informer, so that the many services without one cost no API calls. The SSHExposures routed through the service
+// are synced through d.
+func NewServiceHandler(c kubernetes.Interface, secrets corelisters.SecretLister, d *Dependents, r registry.Registrable, rec record.EventRecorder, l *zap.Logger) SSHServiceHandler {
+	return SSHServiceHandler{
+		client:     c,
+		secrets:    secrets,
+		dependents: d,
+		registry:   r,
+		recorder:   rec,
+		logger:     l,
+	}
+}
+
+func (h SSHServiceHandler) NewCreateHandler() controller.HandleCreate {
+	return &CreateServiceHandler{
+		client:     h.client,
+		secrets:    h.secrets,
+		dependents: h.dependents,
+		registry:   h.registry,
+		recorder:   h.recorder,
+		logger:     h.logger,
+	}
+}
+
+func (h SSHServiceHandler) NewUpdateHandler() controller.HandleUpdate {
+	return &UpdateServiceHandler{
+		client:     h.client,
+		secrets:    h.secrets,
+		dependents: h.dependents,
+		registry:   h.registry,
+		recorder:   h.recorder,
+		logger:     h.logger,
+	}
+}
+
+func (h SSHServiceHandler) NewDeleteHandler() controller.HandleDelete {
+	return &DeleteServiceHandler{
+		client:     h.client,
+		secrets:    h.secrets,
+		dependents: h.dependents,
+		registry:   h.registry,
+		recorder:   h.recorder,
+		logger:     h.logger,
+	}
+}
+
+func (ch *CreateServiceHandler) Handle() error {
+	return observe(resourceService, eventCreate, ch.handle)
+}
+
+func (ch *CreateServiceHandler) handle() error {
+	service, ok := ch.newValue.(*v1.Service)
+	if !ok {
+		return handleTypeAssertionError(ch.logger, ch.newValue)
+	}
+	ch.dependents.sync(exposure.ServiceIndex, service.Namespace, service.Name)
+	return registerServiceUpstream(service, ch.client, ch.secrets, ch.registry, ch.recorder, ch.logger)
+}
+
+func (ch *CreateServiceHandler) SetObject(object interface{}) {
+	ch.newValue = object
+}
+
+func (uh *UpdateServiceHandler) Handle() error {
+	return observe(resourceService, eventUpdate, uh.handle)
+}
+
+func (uh *UpdateServiceHandler) handle() error {
+	old, ok := uh.oldValue.(*v1.Service)
+	if !ok {
+		return handleTypeAssertionError(uh.logger, uh.oldValue)
+	}
+
+	new, ok := uh.newValue.(*v1.Service)
+	if !ok {
+		return handleTypeAssertionError(uh.logger, uh.newValue)
+	}
+
+	if old.ResourceVersion == new.ResourceVersion {
+		// nothing to do
+		return skipped(skipUnchanged)
+	}
+	// exposures select their port themselves, so any change may affect them
+	uh.dependents.sync(exposure.ServiceIndex, new.Namespace, new.Name)
+	if isRoutable(old) && !isRoutable(new) {
+		// the registration would keep routing to a port or cluster IP which is gone
+		if err := unregisterServiceUpstream(new, uh.registry, uh.logger); err != nil {
+			return err
+		}
+		uh.recorder.Event(new, v1.EventTypeWarning, ReasonUnregistered, "the service no longer exposes a usable ssh port")
+		return nil
+	}
+	return registerServiceUpstream(new, uh.client, uh.secrets, uh.registry, uh.recorder, uh.logger)
+}
+
+func (uh *UpdateServiceHandler) SetObjects(old, new interface{}) {
+	uh.oldValue = old
+	uh.newValue = new
+}
+
+func (dh *DeleteServiceHandler) Handle() error {
+	return observe(resourceService, eventDelete, dh.handle)
+}
+
+func (dh *DeleteServiceHandler) handle() error {
+	service, ok := dh.oldValue.(*v1.Service)
+	if !ok {
+		return handleTypeAssertionError(dh.logger, dh.oldValue)
+	}
+
+	dh.dependents.sync(exposure.ServiceIndex, service.Namespace, service.Name)
+	// the secret may well still exist but without a service there is nothing left to route to
+	return unregisterServiceUpstream(service, dh.registry, dh.logger)
+}
+
+func (dh *DeleteServiceHandler) SetObject(object interface{}) {
+	dh.oldValue = object
+}
+
+// registerServiceUpstream registers the upstream for the secret sharing the name of the service, if there is one
+func registerServiceUpstream(service *v1.Service, client kubernetes.Interface, secrets corelisters.SecretLister, r registry.Registrable, rec record.EventRecorder, l *zap.Logger) error {
+	if !isRoutable(service) {
+		l.Debug("service exposes no usable ssh port", zap.String("name", service.Name), zap.String("namespace", service.Namespace))
+		return skipped(skipNoSSHPort)
+	}
+
+	secret, err := getSSHSecret(service.Name, service.Namespace, secrets)
+	if err != nil {
+		return err
+	}
+	if secret == nil {
+		// the secret handler will register the upstream once the secret appears
+		l.Debug("no secret found for service", zap.String("name", service.Name), zap.String("namespace", service.Namespace))
+		return skipped(skipSecretNotFound)
+	}
+
+	return syncSecret(secret, service, client, r, rec, l)
+}
+
+// unregisterServiceUpstream removes the upstream of the secret sharing the name of the service
+func unregisterServiceUpstream(service *v1.Service, r registry.Registrable, l *zap.Logger) error {
+	u := &registry.Upstream{
+		Name: upstreamName(service.Namespace, service.Name),
+	}
+	err := r.UnregisterUpstream(u)
+	switch err {
+	case sql.ErrNoRows:
+		// the secret was never registered or has already been cleaned up by the secret handler
+		l.Debug("no upstream to unregister for service", zap.String("name", service.Name), zap.String("namespace", service.Namespace))
+		return skipped(skipNotRegistered)
+	default:
+		return err
+	}
+}
+
+// getSSHSecret corresponding to the name, typically provided from the service, from the cache of exposed secrets.
+// The cached secret is copied as the handlers annotate it.
+func getSSHSecret(name, namespace string, secrets corelisters.SecretLister) (*v1.Secret, error) {
+	secret, err := secrets.Secrets(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return secret.DeepCopy(), nil
+}
@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/exposure"
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/metrics"
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/registry"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestSSHServiceHandlerCreate(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	l, _ := zap.NewDevelopment()
+
+	secret, s, b64 := getValidSSHSecret(t)
+	_, err := c.CoreV1().Secrets(testNamespace).Create(secret)
+	if err != nil {
+		t.Errorf("error when creating test secret")
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	handler := NewServiceHandler(c, newSecretLister(t, c, stopCh), nil, mockRegistry{}, record.NewFakeRecorder(10), l)
+	ch := handler.NewCreateHandler()
+
+	service, err := c.CoreV1().Services(testNamespace).Create(getValidSSHService(t))
+	if err != nil {
+		t.Errorf("error when creating test service")
+	}
+
+	ch.SetObject(service)
+
+	err = ch.Handle()
+	if err != nil {
+		t.Errorf("unexpected error when handling create event - %v", err)
+	}
+
+	upstream := <-resultChan
+	result, ok := upstream.(*registry.Upstream)
+	if !ok {
+		t.Errorf("unexpected type assertion - got %v", result)
+	}
+
+	expect := &registry.Upstream{
+		Name:                validUpstreamName,
+		Username:            validNames,
+		UpstreamUsername:    validNames,
+		Address:             staticAddress,
+		SSHPiperPrivateKey:  s,
+		DownstreamPublicKey: b64,
+	}
+
+	if !reflect.DeepEqual(result, expect) {
+		t.Errorf("unexpected result, expected \n %v \n but got \n%v", expect, result)
+	}
+}
+
+func TestSSHServiceHandlerCreateWithoutSecret(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	l, _ := zap.NewDevelopment()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	handler := NewServiceHandler(c, newSecretLister(t, c, stopCh), nil, mockRegistry{}, record.NewFakeRecorder(10), l)
+
+	ch := handler.NewCreateHandler()
+
+	service, err := c.CoreV1().Services(testNamespace).Create(getValidSSHService(t))
+	if err != nil {
+		t.Errorf("error when creating test service")
+	}
+
+	ch.SetObject(service)
+
+	skips := metrics.HandlerEvents.WithLabelValues(resourceService, eventCreate, metrics.OutcomeSkipped, skipSecretNotFound)
+	before := testutil.ToFloat64(skips)
+
+	err = ch.Handle()
+	if err != nil {
+		t.Errorf("unexpected error when handling create event - %v", err)
+	}
+
+	select {
+	case upstream := <-resultChan:
+		t.Errorf("unexpected registration without a secret - got %v", upstream)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if after := testutil.ToFloat64(skips); after != before+1 {
+		t.Errorf("expected the skip to be counted - got %v after %v", after, before)
+	}
+}
+
+func TestSSHServiceHandlerDelete(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	l, _ := zap.NewDevelopment()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	handler := NewServiceHandler(c, newSecretLister(t, c, stopCh), nil, mockRegistry{}, record.NewFakeRecorder(10), l)
+
+	dh := handler.NewDeleteHandler()
+	dh.SetObject(getValidSSHService(t))
+
+	err := dh.Handle()
+	if err != nil {
+		t.Errorf("unexpected error when handling delete event - %v", err)
+	}
+
+	upstream := <-resultChan
+	result, ok := upstream.(*registry.Upstream)
+	if !ok {
+		t.Errorf("unexpected type assertion - got %v", result)
+	}
+
+	expect := &registry.Upstream{
+		Name: validUpstreamName,
+	}
+
+	if !reflect.DeepEqual(result, expect) {
+		t.Errorf("unexpected result, expected \n %v \n but got \n%v", expect, result)
+	}
+}
+
+func TestSSHServiceHandlerUpdateUnroutable(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	l, _ := zap.NewDevelopment()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	recorder := record.NewFakeRecorder(10)
+	handler := NewServiceHandler(c, newSecretLister(t, c, stopCh), nil, mockRegistry{}, recorder, l)
+
+	old := getValidSSHService(t)
+	old.ResourceVersion = "1"
+	new := old.DeepCopy()
+	new.ResourceVersion = "2"
+	new.Spec.Ports[0].Name = "http"
+	new.Spec.Ports[0].Port = 80
+
+	uh := handler.NewUpdateHandler()
+	uh.SetObjects(old, new)
+	if err := uh.Handle(); err != nil {
+		t.Errorf("unexpected error when handling update event - %v", err)
+	}
+
+	upstream := <-resultChan
+	expect := &registry.Upstream{
+		Name: validUpstreamName,
+	}
+	if !reflect.DeepEqual(upstream, expect) {
+		t.Errorf("expected the upstream to be unregistered, expected \n %v \n but got \n%v", expect, upstream)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, ReasonUnregistered) {
+		t.Errorf("unexpected event - got %v", event)
+	}
+}
+
+func TestSSHServiceHandlerDeleteSyncsExposures(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	l, _ := zap.NewDevelopment()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	r := &recordingRegistry{}
+
+	secret, _, _ := getValidSSHSecret(t)
+	object := getValidSSHExposure(t, string(secret.Data[DownstreamPublicKeyKey]))
+	exposures := cache.NewIndexer(cache.MetaNamespaceKeyFunc, exposure.Indexers)
+	if err := exposures.Add(object); err != nil {
+		t.Fatalf("error when indexing test exposure - %v", err)
+	}
+	dependents := NewExposureHandler(c, newFakeDynamicClient(object), r, record.NewFakeRecorder(10), l).Dependents(exposures)
+	handler := NewServiceHandler(c, newSecretLister(t, c, stopCh), dependents, r, record.NewFakeRecorder(10), l)
+
+	dh := handler.NewDeleteHandler()
+	dh.SetObject(getValidSSHService(t))
+	if err := dh.Handle(); err != nil {
+		t.Errorf("unexpected error when handling delete event - %v", err)
+	}
+
+	expect := []string{exposureUpstreamName(testNamespace, validExposureName), validUpstreamName}
+	if !reflect.DeepEqual(r.unregistered, expect) {
+		t.Errorf("expected the exposure routed through the service to be unregistered, expected %v but got %v", expect, r.unregistered)
+	}
+}
+
+func TestSSHServiceHandlerIgnoresUnlabelledSecret(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	l, _ := zap.NewDevelopment()
+
+	secret, _, _ := getValidSSHSecret(t)
+	secret.Labels = nil
+	_, err := c.CoreV1().Secrets(testNamespace).Create(secret)
+	if err != nil {
+		t.Errorf("error when creating test secret")
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	handler := NewServiceHandler(c, newSecretLister(t, c, stopCh), nil, mockRegistry{}, record.NewFakeRecorder(10), l)
+	ch := handler.NewCreateHandler()
+
+	service, err := c.CoreV1().Services(testNamespace).Create(getValidSSHService(t))
+	if err != nil {
+		t.Errorf("error when creating test service")
+	}
+
+	ch.SetObject(service)
+
+	err = ch.Handle()
+	if err != nil {
+		t.Errorf("unexpected error when handling create event - %v", err)
+	}
+
+	select {
+	case upstream := <-resultChan:
+		t.Errorf("unexpected registration of a secret without the %s label - got %v", ExposeLabel, upstream)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// newSecretLister serves the exposed secrets of the client from the cache of a running informer, as for the controller
+func newSecretLister(t *testing.T, c kubernetes.Interface, stopCh <-chan struct{}) corelisters.SecretLister {
+	t.Helper()
+	informer := NewSecretInformer(c, testNamespace, 0)
+	go informer.Informer().Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, informer.Informer().HasSynced) {
+		t.Fatalf("secret informer cache did not sync")
+	}
+	return informer.Lister()
+}
@@ -0,0 +1,151 @@
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type check struct {
+	name string
+	fn   func() error
+}
+
+// Checker serves /healthz and /readyz, failing with 503 and the failed checks when any check returns an error
+type Checker struct {
+	mu        sync.RWMutex
+	liveness  []check
+	readiness []check
+}
+
+func NewChecker() *Checker {
+	return &Checker{}
+}
+
+// AddLivenessCheck fails /healthz, restarting the controller, when fn returns an error
+func (c *Checker) AddLivenessCheck(name string, fn func() error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.liveness = append(c.liveness, check{name, fn})
+}
+
+// AddReadinessCheck fails /readyz when fn returns an error
+func (c *Checker) AddReadinessCheck(name string, fn func() error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readiness = append(c.readiness, check{name, fn})
+}
+
+// Install the endpoints on the mux
+func (c *Checker) Install(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		c.mu.RLock()
+		checks := c.liveness
+		c.mu.RUnlock()
+		serve(w, checks)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		c.mu.RLock()
+		checks := c.readiness
+		c.mu.RUnlock()
+		serve(w, checks)
+	})
+}
+
+// serve writes a line per check in the format of the Kubernetes components
+func serve(w http.ResponseWriter, checks []check) {
+	status := http.StatusOK
+	var body string
+	for _, c := range checks {
+		if err := c.fn(); err != nil {
+			status = http.StatusServiceUnavailable
+			body += fmt.Sprintf("[-]%s failed: %v\n", c.name, err)
+			continue
+		}
+		body += fmt.Sprintf("[+]%s ok\n", c.name)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	if status == http.StatusOK {
+		body += "ok\n"
+	}
+	fmt.Fprint(w, body)
+}
+
+// Workers tracks calls in flight so that a call which never returns, wedging the worker running it, fails liveness
+type Workers struct {
+	mu      sync.Mutex
+	next    uint64
+	started map[uint64]time.Time
+	// draining refuses new calls, idle is closed once the last call in flight ends
+	draining bool
+	idle     chan struct{}
+}
+
+func NewWorkers() *Workers {
+	return &Workers{started: map[uint64]time.Time{}}
+}
+
+// Begin a call, the returned function ends it. Begin returns false once Drain has been called and the call must not
+// run.
+func (w *Workers) Begin() (func(), bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.draining {
+		return nil, false
+	}
+	id := w.next
+	w.next++
+	w.started[id] = time.Now()
+	return func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		delete(w.started, id)
+		if w.draining && len(w.started) == 0 {
+			close(w.idle)
+		}
+	}, true
+}
+
+// Drain refuses new calls and waits for those in flight to end, failing when some are still running after timeout
+func (w *Workers) Drain(timeout time.Duration) error {
+	w.mu.Lock()
+	if !w.draining {
+		w.draining = true
+		w.idle = make(chan struct{})
+		if len(w.started) == 0 {
+			close(w.idle)
+		}
+	}
+	idle := w.idle
+	w.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-time.After(timeout):
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return fmt.Errorf("%d calls still running after %v", len(w.started), timeout)
+	}
+}
+
+// Check fails when a call has been running for longer than timeout
+func (w *Workers) Check(timeout time.Duration) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var stuck int
+	for _, started := range w.started {
+		if time.Since(started) > timeout {
+			stuck++
+		}
+	}
+	if stuck > 0 {
+		return fmt.Errorf("%d calls running for longer than %v", stuck, timeout)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package health
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChecker(t *testing.T) {
+	c := NewChecker()
+	c.AddLivenessCheck("alive", func() error { return nil })
+	c.AddReadinessCheck("database", func() error { return errors.New("connection refused") })
+
+	mux := http.NewServeMux()
+	c.Install(mux)
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{path: "/healthz", status: http.StatusOK, body: "[+]alive ok"},
+		{path: "/readyz", status: http.StatusServiceUnavailable, body: "[-]database failed: connection refused"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.status || !strings.Contains(rec.Body.String(), tt.body) {
+				t.Errorf("expected %d mentioning %q - got %d %q", tt.status, tt.body, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	w := NewWorkers()
+
+	done, _ := w.Begin()
+	time.Sleep(10 * time.Millisecond)
+	if err := w.Check(time.Millisecond); err == nil {
+		t.Errorf("expected a call running past the timeout to fail the check")
+	}
+	if err := w.Check(time.Minute); err != nil {
+		t.Errorf("unexpected error within the timeout - %v", err)
+	}
+
+	done()
+	if err := w.Check(time.Millisecond); err != nil {
+		t.Errorf("unexpected error once the call returned - %v", err)
+	}
+}
+
+func TestWorkersDrain(t *testing.T) {
+	w := NewWorkers()
+
+	done, _ := w.Begin()
+	if err := w.Drain(time.Millisecond); err == nil {
+		t.Errorf("expected draining to time out while a call is running")
+	}
+	if _, ok := w.Begin(); ok {
+		t.Errorf("expected new calls to be refused while draining")
+	}
+
+	go done()
+	if err := w.Drain(time.Second); err != nil {
+		t.Errorf("unexpected error once the call returned - %v", err)
+	}
+}
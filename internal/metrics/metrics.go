@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/registry"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "ksce"
+
+// Outcomes of a handler event
+const (
+	OutcomeSuccess = "success"
+	OutcomeSkipped = "skipped"
+	OutcomeError   = "error"
+)
+
+// Kinds of drift between the cluster and the registry
+const (
+	DriftMissing  = "missing"
+	DriftChanged  = "changed"
+	DriftOrphaned = "orphaned"
+)
+
+var (
+	// HandlerEvents counts the events handled per resource, event and outcome. Skipped events carry the reason
+	// they left the registry untouched, which matches the event reason where one was recorded.
+	HandlerEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "handler_events_total",
+		Help:      "Events handled by resource, event and outcome, with the reason of skipped events.",
+	}, []string{"resource", "event", "outcome", "reason"})
+
+	RegistryOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "registry_operation_duration_seconds",
+		Help:      "Latency of registry operations by operation and result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "result"})
+
+	// RegisteredUpstreams is set by the audit, counting the upstreams of each namespace found in the registry
+	RegisteredUpstreams = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "registered_upstreams",
+		Help:      "Upstreams expected from the cluster which are registered, by namespace.",
+	}, []string{"namespace"})
+
+	// RegistryDrift is set by the audit, counting upstreams missing from the registry, registered with outdated
+	// details or registered without a matching object in the cluster
+	RegistryDrift = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "registry_drift_upstreams",
+		Help:      "Upstreams differing between the cluster and the registry, by kind of drift.",
+	}, []string{"kind"})
+)
+
+func init() {
+	prometheus.MustRegister(HandlerEvents, RegistryOperationDuration, RegisteredUpstreams, RegistryDrift)
+}
+
+// Drift of the registry found by an audit
+type Drift struct {
+	Missing, Changed, Orphaned int
+	// Registered upstreams by namespace
+	Registered map[string]int
+}
+
+// SetDrift replaces the gauges set by the previous audit, so that namespaces without upstreams disappear
+func SetDrift(d Drift) {
+	RegistryDrift.WithLabelValues(DriftMissing).Set(float64(d.Missing))
+	RegistryDrift.WithLabelValues(DriftChanged).Set(float64(d.Changed))
+	RegistryDrift.WithLabelValues(DriftOrphaned).Set(float64(d.Orphaned))
+
+	RegisteredUpstreams.Reset()
+	for ns, count := range d.Registered {
+		RegisteredUpstreams.WithLabelValues(ns).Set(float64(count))
+	}
+}
+
+// instrumentedRegistry times the operations of the wrapped registry
+type instrumentedRegistry struct {
+	registry.Registrable
+}
+
+// InstrumentRegistry records the latency of every operation of r
+func InstrumentRegistry(r registry.Registrable) registry.Registrable {
+	return instrumentedRegistry{r}
+}
+
+func (r instrumentedRegistry) RegisterUpstream(upstream *registry.Upstream) (*registry.Upstream, error) {
+	start := time.Now()
+	u, err := r.Registrable.RegisterUpstream(upstream)
+	observeOperation("register", start, err)
+	return u, err
+}
+
+func (r instrumentedRegistry) UnregisterUpstream(upstream *registry.Upstream) error {
+	start := time.Now()
+	err := r.Registrable.UnregisterUpstream(upstream)
+	observeOperation("unregister", start, err)
+	return err
+}
+
+func (r instrumentedRegistry) ListUpstreams() ([]*registry.Upstream, error) {
+	start := time.Now()
+	upstreams, err := r.Registrable.ListUpstreams()
+	observeOperation("list", start, err)
+	return upstreams, err
+}
+
+// Ping is answered by the wrapped registry
+func (r instrumentedRegistry) Ping() error {
+	return registry.Ping(r.Registrable)
+}
+
+// Close closes the wrapped registry
+func (r instrumentedRegistry) Close() error {
+	return registry.Close(r.Registrable)
+}
+
+// VerifiesCertificates is answered by the wrapped registry
+func (r instrumentedRegistry) VerifiesCertificates() bool {
+	return registry.VerifiesCertificates(r.Registrable)
+}
+
+// observeOperation records the result of an operation, where unregistering an upstream which is not registered is
+// skipped rather than failed
+func observeOperation(operation string, start time.Time, err error) {
+	result := OutcomeSuccess
+	if err == sql.ErrNoRows {
+		result = OutcomeSkipped
+	} else if err != nil {
+		result = OutcomeError
+	}
+	RegistryOperationDuration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,264 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/registry"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// upstreamExtension carries the name of the upstream a login was authorized for from authentication to routing
+const upstreamExtension = "ksce-upstream"
+
+// Config of the embedded proxy, set through the KSCE_PROXY_* env vars or the proxy section of the config file
+type Config struct {
+	ListenAddress string `yaml:"listenAddress" split_words:"true"`
+	// HostKeyFile holds the private host key, a key generated at startup is used when empty
+	HostKeyFile string        `yaml:"hostKeyFile" split_words:"true"`
+	DialTimeout time.Duration `yaml:"dialTimeout" split_words:"true"`
+	// InsecureIgnoreHostKeys connects to upstreams without pinned host keys instead of refusing them, leaving the
+	// sshpiper key and the session open to anyone able to intercept traffic to the Service
+	InsecureIgnoreHostKeys bool `yaml:"insecureIgnoreHostKeys" split_words:"true"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ListenAddress: ":2222",
+		DialTimeout:   10 * time.Second,
+	}
+}
+
+// Resolver finds the upstream a login name routes to
+type Resolver interface {
+	Lookup(username string) (*registry.Upstream, bool)
+}
+
+// Server accepts ssh connections, authorizes them against the upstream of the login name and pipes every channel and
+// request to a connection it opens to the upstream with the sshpiper key. Unlike sshpiper, both legs are separate
+// ssh connections, so downstream keys and certificates are checked here and never reach the container, and the
+// container has to present one of the host keys pinned on the upstream.
+type Server struct {
+	resolver               Resolver
+	hostKey                ssh.Signer
+	dialTimeout            time.Duration
+	insecureIgnoreHostKeys bool
+	logger                 *zap.Logger
+}
+
+func NewServer(r Resolver, hostKey ssh.Signer, conf Config, l *zap.Logger) *Server {
+	return &Server{
+		resolver:               r,
+		hostKey:                hostKey,
+		dialTimeout:            conf.DialTimeout,
+		insecureIgnoreHostKeys: conf.InsecureIgnoreHostKeys,
+		logger:                 l,
+	}
+}
+
+// LoadHostKey reads the host key from path, generating an ed25519 key when path is empty
+func LoadHostKey(path string) (ssh.Signer, error) {
+	if path == "" {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return ssh.NewSignerFromKey(key)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host key %s - %v", path, err)
+	}
+	return signer, nil
+}
+
+// Serve connections accepted on the listener until it is closed
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	config := &ssh.ServerConfig{PublicKeyCallback: s.authorize}
+	config.AddHostKey(s.hostKey)
+
+	downstream, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		s.logger.Debug("Handshake failed", zap.String("remote", conn.RemoteAddr().String()), zap.Error(err))
+		return
+	}
+	defer downstream.Close()
+
+	l := s.logger.With(zap.String("username", downstream.User()), zap.String("remote", conn.RemoteAddr().String()))
+
+	// the upstream may have been unregistered or replaced since the login was authorized
+	u, ok := s.resolver.Lookup(downstream.User())
+	if !ok || u.Name != downstream.Permissions.Extensions[upstreamExtension] {
+		l.Info("Upstream changed during login")
+		return
+	}
+
+	upstream, upstreamChans, upstreamReqs, err := s.dial(u)
+	if err != nil {
+		l.Error("Failed to connect to upstream", zap.String("name", u.Name), zap.String("address", u.Address), zap.Error(err))
+		return
+	}
+	defer upstream.Close()
+
+	l.Info("Connection piped", zap.String("name", u.Name), zap.String("address", u.Address))
+
+	go forwardRequests(reqs, upstream)
+	go forwardRequests(upstreamReqs, downstream)
+	go forwardChannels(upstreamChans, downstream)
+	go forwardChannels(chans, upstream)
+
+	// whichever side hangs up first takes the other one down
+	go func() {
+		upstream.Wait()
+		downstream.Close()
+	}()
+	downstream.Wait()
+	l.Info("Connection closed")
+}
+
+func (s *Server) authorize(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	u, ok := s.resolver.Lookup(conn.User())
+	if !ok {
+		return nil, errors.New("no upstream for username")
+	}
+	permissions, err := u.Authorize(key)
+	if err != nil {
+		return nil, err
+	}
+	// the critical options of certificates, such as source-address, are enforced by the handshake
+	if permissions.Extensions == nil {
+		permissions.Extensions = map[string]string{}
+	}
+	permissions.Extensions[upstreamExtension] = u.Name
+	return permissions, nil
+}
+
+func (s *Server) dial(u *registry.Upstream) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
+	signer, err := ssh.ParsePrivateKey([]byte(u.SSHPiperPrivateKey))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hostKeyCallback := func(_ string, _ net.Addr, key ssh.PublicKey) error {
+		return u.VerifyHostKey(key)
+	}
+	if len(u.UpstreamHostKeys) == 0 {
+		if !s.insecureIgnoreHostKeys {
+			// the sshpiper key would be offered to whoever answers on the address
+			return nil, nil, nil, errors.New("no upstream host keys are pinned")
+		}
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	}
+
+	conn, err := net.DialTimeout("tcp", u.Address, s.dialTimeout)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	config := &ssh.ClientConfig{
+		User:              u.UpstreamUsername,
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: u.HostKeyAlgorithms(),
+		Timeout:           s.dialTimeout,
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, u.Address, config)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	return c, chans, reqs, nil
+}
+
+// forwardRequests relays global requests, such as tcpip-forward, and their replies
+func forwardRequests(in <-chan *ssh.Request, out ssh.Conn) {
+	for req := range in {
+		ok, payload, err := out.SendRequest(req.Type, req.WantReply, req.Payload)
+		if req.WantReply {
+			req.Reply(ok && err == nil, payload)
+		}
+	}
+}
+
+func forwardChannels(in <-chan ssh.NewChannel, out ssh.Conn) {
+	for newChannel := range in {
+		go forwardChannel(newChannel, out)
+	}
+}
+
+// forwardChannel opens the same channel on the other side and pipes its data, stderr and requests until it closes
+func forwardChannel(newChannel ssh.NewChannel, out ssh.Conn) {
+	target, targetReqs, err := out.OpenChannel(newChannel.ChannelType(), newChannel.ExtraData())
+	if err != nil {
+		if openErr, ok := err.(*ssh.OpenChannelError); ok {
+			newChannel.Reject(openErr.Reason, openErr.Message)
+		} else {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		}
+		return
+	}
+	source, sourceReqs, err := newChannel.Accept()
+	if err != nil {
+		target.Close()
+		return
+	}
+
+	go func() {
+		io.Copy(target, source)
+		target.CloseWrite()
+	}()
+	go io.Copy(target.Stderr(), source.Stderr())
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(source, target)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(source.Stderr(), target.Stderr())
+	}()
+
+	go func() {
+		forwardChannelRequests(sourceReqs, target)
+		target.Close()
+	}()
+	// requests such as exit-status arrive before the target closes, its remaining output is flushed before closing
+	forwardChannelRequests(targetReqs, source)
+	wg.Wait()
+	source.CloseWrite()
+	source.Close()
+}
+
+func forwardChannelRequests(in <-chan *ssh.Request, out ssh.Channel) {
+	for req := range in {
+		ok, err := out.SendRequest(req.Type, req.WantReply, req.Payload)
+		if req.WantReply {
+			req.Reply(ok && err == nil, nil)
+		}
+	}
+}
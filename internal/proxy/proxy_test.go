@@ -0,0 +1,305 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/EP4/kubernetes-ssh-container-exposer/internal/registry"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestServerPipesSession(t *testing.T) {
+	l, _ := zap.NewDevelopment()
+	sshpiperKey, sshpiperPEM := newTestKey(t)
+	downstreamKey, _ := newTestKey(t)
+	hostKey, err := LoadHostKey("")
+	if err != nil {
+		t.Fatalf("failed to generate host key - %v", err)
+	}
+
+	upstream := newTestUpstream(t, hostKey, sshpiperKey.PublicKey(), "root")
+	defer upstream.Close()
+
+	r := registry.NewMemory(l)
+	if _, err := r.RegisterUpstream(&registry.Upstream{
+		Name:                "default-app",
+		Username:            "alice",
+		UpstreamUsername:    "root",
+		Address:             upstream.Addr().String(),
+		SSHPiperPrivateKey:  string(sshpiperPEM),
+		DownstreamPublicKey: []string{base64.StdEncoding.EncodeToString(downstreamKey.PublicKey().Marshal())},
+		UpstreamHostKeys:    []string{base64.StdEncoding.EncodeToString(hostKey.PublicKey().Marshal())},
+	}); err != nil {
+		t.Fatalf("failed to register upstream - %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen - %v", err)
+	}
+	defer listener.Close()
+	go NewServer(r, hostKey, Config{DialTimeout: time.Second}, l).Serve(listener)
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), newTestClientConfig("alice", downstreamKey))
+	if err != nil {
+		t.Fatalf("unexpected error when connecting - %v", err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("unexpected error when opening session - %v", err)
+	}
+	output, err := session.Output("whoami")
+	if err != nil {
+		t.Errorf("unexpected error when running command - %v", err)
+	}
+	if string(output) != "root ran whoami" {
+		t.Errorf("unexpected output - got %q", output)
+	}
+
+	otherKey, _ := newTestKey(t)
+	if c, err := ssh.Dial("tcp", listener.Addr().String(), newTestClientConfig("alice", otherKey)); err == nil {
+		c.Close()
+		t.Errorf("expected an unlisted key to be rejected")
+	}
+	if c, err := ssh.Dial("tcp", listener.Addr().String(), newTestClientConfig("bob", downstreamKey)); err == nil {
+		c.Close()
+		t.Errorf("expected an unknown username to be rejected")
+	}
+}
+
+func TestServerCertificateOptions(t *testing.T) {
+	l, _ := zap.NewDevelopment()
+	ca, _ := newTestKey(t)
+	user, _ := newTestKey(t)
+	hostKey, err := LoadHostKey("")
+	if err != nil {
+		t.Fatalf("failed to generate host key - %v", err)
+	}
+
+	r := registry.NewMemory(l)
+	if _, err := r.RegisterUpstream(&registry.Upstream{
+		Name:              "default-app",
+		Username:          "alice",
+		UpstreamUsername:  "root",
+		Address:           "127.0.0.1:1",
+		TrustedUserCAKeys: []string{base64.StdEncoding.EncodeToString(ca.PublicKey().Marshal())},
+	}); err != nil {
+		t.Fatalf("failed to register upstream - %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen - %v", err)
+	}
+	defer listener.Close()
+	go NewServer(r, hostKey, Config{DialTimeout: time.Second}, l).Serve(listener)
+
+	tests := []struct {
+		name       string
+		principals []string
+		options    map[string]string
+		accepted   bool
+	}{
+		{name: "principal", principals: []string{"alice"}, accepted: true},
+		{name: "no principals"},
+		{name: "source address", principals: []string{"alice"}, options: map[string]string{"source-address": "127.0.0.1/32"}, accepted: true},
+		{name: "other source address", principals: []string{"alice"}, options: map[string]string{"source-address": "10.0.0.0/8"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert := &ssh.Certificate{
+				Key:             user.PublicKey(),
+				CertType:        ssh.UserCert,
+				ValidPrincipals: tt.principals,
+				ValidBefore:     ssh.CertTimeInfinity,
+				Permissions:     ssh.Permissions{CriticalOptions: tt.options},
+			}
+			if err := cert.SignCert(rand.Reader, ca); err != nil {
+				t.Fatalf("failed to sign certificate - %v", err)
+			}
+			signer, err := ssh.NewCertSigner(cert, user)
+			if err != nil {
+				t.Fatalf("failed to create certificate signer - %v", err)
+			}
+
+			// the login is authorized during the handshake, before the unreachable upstream is dialled
+			c, err := ssh.Dial("tcp", listener.Addr().String(), newTestClientConfig("alice", signer))
+			if err == nil {
+				c.Close()
+			}
+			if accepted := err == nil; accepted != tt.accepted {
+				t.Errorf("expected accepted to be %v - got error %v", tt.accepted, err)
+			}
+		})
+	}
+}
+
+func TestServerVerifiesUpstreamHostKeys(t *testing.T) {
+	l, _ := zap.NewDevelopment()
+	sshpiperKey, sshpiperPEM := newTestKey(t)
+	downstreamKey, _ := newTestKey(t)
+	hostKey, err := LoadHostKey("")
+	if err != nil {
+		t.Fatalf("failed to generate host key - %v", err)
+	}
+	otherKey, _ := newTestKey(t)
+
+	upstream := newTestUpstream(t, hostKey, sshpiperKey.PublicKey(), "root")
+	defer upstream.Close()
+
+	tests := []struct {
+		name     string
+		pinned   []ssh.PublicKey
+		insecure bool
+		piped    bool
+	}{
+		{name: "pinned", pinned: []ssh.PublicKey{otherKey.PublicKey(), hostKey.PublicKey()}, piped: true},
+		{name: "not pinned", pinned: []ssh.PublicKey{otherKey.PublicKey()}, insecure: true},
+		{name: "nothing pinned", pinned: nil},
+		{name: "nothing pinned, insecure", pinned: nil, insecure: true, piped: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pinned []string
+			for _, key := range tt.pinned {
+				pinned = append(pinned, base64.StdEncoding.EncodeToString(key.Marshal()))
+			}
+			r := registry.NewMemory(l)
+			if _, err := r.RegisterUpstream(&registry.Upstream{
+				Name:                "default-app",
+				Username:            "alice",
+				UpstreamUsername:    "root",
+				Address:             upstream.Addr().String(),
+				SSHPiperPrivateKey:  string(sshpiperPEM),
+				DownstreamPublicKey: []string{base64.StdEncoding.EncodeToString(downstreamKey.PublicKey().Marshal())},
+				UpstreamHostKeys:    pinned,
+			}); err != nil {
+				t.Fatalf("failed to register upstream - %v", err)
+			}
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("failed to listen - %v", err)
+			}
+			defer listener.Close()
+			go NewServer(r, hostKey, Config{DialTimeout: time.Second, InsecureIgnoreHostKeys: tt.insecure}, l).Serve(listener)
+
+			client, err := ssh.Dial("tcp", listener.Addr().String(), newTestClientConfig("alice", downstreamKey))
+			if err != nil {
+				t.Fatalf("unexpected error when connecting - %v", err)
+			}
+			defer client.Close()
+
+			// the downstream handshake completes before the upstream is dialled, refusals close the connection
+			session, err := client.NewSession()
+			if err == nil {
+				_, err = session.Output("whoami")
+			}
+			if piped := err == nil; piped != tt.piped {
+				t.Errorf("expected piped to be %v - got error %v", tt.piped, err)
+			}
+		})
+	}
+}
+
+// newTestKey returns an ECDSA key as a signer and in PEM, as stored in the sshpiper key of an upstream
+func newTestKey(t *testing.T) (ssh.Signer, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key - %v", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key - %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("failed to create signer - %v", err)
+	}
+	return signer, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func newTestClientConfig(user string, key ssh.Signer) *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(key)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         time.Second,
+	}
+}
+
+// newTestUpstream answers exec requests of the given user with "<user> ran <command>"
+func newTestUpstream(t *testing.T, hostKey ssh.Signer, authorized ssh.PublicKey, user string) net.Listener {
+	t.Helper()
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() != user || !bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, errors.New("unauthorized")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen - %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestUpstream(conn, config)
+		}
+	}()
+	return listener
+}
+
+func serveTestUpstream(conn net.Conn, config *ssh.ServerConfig) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer channel.Close()
+			for req := range requests {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				var exec struct{ Command string }
+				ssh.Unmarshal(req.Payload, &exec)
+				req.Reply(true, nil)
+				channel.Write([]byte(sconn.User() + " ran " + exec.Command))
+				channel.CloseWrite()
+				channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+				return
+			}
+		}()
+	}
+}
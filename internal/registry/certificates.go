@@ -0,0 +1,98 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// CertificateVerifier is implemented by backends which accept user certificates signed by the trusted user CAs of
+// an upstream. Backends which only match listed public keys, such as the sshpiper MySQL schema, do not.
+type CertificateVerifier interface {
+	VerifiesCertificates() bool
+}
+
+// VerifiesCertificates reports whether r accepts user certificates at login
+func VerifiesCertificates(r Registrable) bool {
+	v, ok := r.(CertificateVerifier)
+	return ok && v.VerifiesCertificates()
+}
+
+// Authorize checks a key presented at login, accepting the listed public keys and user certificates signed by a
+// trusted user CA for one of the principals, within the validity window of the certificate. The permissions of a
+// certificate carry its critical options and extensions, the ssh server enforces the source-address option and any
+// other critical option is rejected.
+func (u *Upstream) Authorize(key ssh.PublicKey) (*ssh.Permissions, error) {
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		if containsKey(u.DownstreamPublicKey, key) {
+			return &ssh.Permissions{}, nil
+		}
+		return nil, errors.New("public key is not authorized")
+	}
+
+	if cert.CertType != ssh.UserCert {
+		return nil, errors.New("certificate is not a user certificate")
+	}
+	// CheckCert takes a certificate without principals to be valid for any of them
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, errors.New("certificate has no principals")
+	}
+	checker := ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return containsKey(u.TrustedUserCAKeys, auth)
+		},
+	}
+	if !checker.IsUserAuthority(cert.SignatureKey) {
+		return nil, errors.New("certificate is not signed by a trusted user CA")
+	}
+
+	var err error
+	for _, principal := range u.principals() {
+		// CheckCert verifies the principal, the validity window, the signature and that no critical option other
+		// than source-address is set
+		if err = checker.CheckCert(principal, cert); err == nil {
+			return certificatePermissions(cert), nil
+		}
+	}
+	return nil, fmt.Errorf("certificate is not valid for %s - %v", u.Username, err)
+}
+
+// certificatePermissions copies the options of the certificate, leaving the certificate alone when callers add
+// their own extensions
+func certificatePermissions(cert *ssh.Certificate) *ssh.Permissions {
+	permissions := &ssh.Permissions{
+		CriticalOptions: make(map[string]string, len(cert.CriticalOptions)),
+		Extensions:      make(map[string]string, len(cert.Extensions)),
+	}
+	for k, v := range cert.CriticalOptions {
+		permissions.CriticalOptions[k] = v
+	}
+	for k, v := range cert.Extensions {
+		permissions.Extensions[k] = v
+	}
+	return permissions
+}
+
+// principals accepted in certificates, the downstream username unless set
+func (u *Upstream) principals() []string {
+	if len(u.Principals) > 0 {
+		return u.Principals
+	}
+	return []string{u.Username}
+}
+
+// containsKey reports whether the key is among keys in the base64 wire format sshpiper stores
+func containsKey(keys []string, key ssh.PublicKey) bool {
+	marshalled := key.Marshal()
+	for _, k := range keys {
+		raw, err := base64.StdEncoding.DecodeString(k)
+		if err == nil && bytes.Equal(raw, marshalled) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package registry
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestUpstreamAuthorize(t *testing.T) {
+	ca := newTestSigner(t)
+	untrustedCA := newTestSigner(t)
+	listed := newTestSigner(t)
+	user := newTestSigner(t)
+
+	u := &Upstream{
+		Username:            "alice",
+		DownstreamPublicKey: []string{base64.StdEncoding.EncodeToString(listed.PublicKey().Marshal())},
+		TrustedUserCAKeys:   []string{base64.StdEncoding.EncodeToString(ca.PublicKey().Marshal())},
+	}
+
+	now := time.Now()
+	tests := []struct {
+		name   string
+		key    ssh.PublicKey
+		expect string
+	}{
+		{name: "listed key", key: listed.PublicKey()},
+		{name: "unlisted key", key: user.PublicKey(), expect: "not authorized"},
+		{name: "certificate", key: newTestCertificate(t, ca, user, ssh.UserCert, "alice", now.Add(-time.Hour), now.Add(time.Hour))},
+		{name: "expired certificate", key: newTestCertificate(t, ca, user, ssh.UserCert, "alice", now.Add(-2*time.Hour), now.Add(-time.Hour)), expect: "expired"},
+		{name: "future certificate", key: newTestCertificate(t, ca, user, ssh.UserCert, "alice", now.Add(time.Hour), now.Add(2*time.Hour)), expect: "not yet valid"},
+		{name: "other principal", key: newTestCertificate(t, ca, user, ssh.UserCert, "bob", now.Add(-time.Hour), now.Add(time.Hour)), expect: "principal"},
+		{name: "untrusted CA", key: newTestCertificate(t, untrustedCA, user, ssh.UserCert, "alice", now.Add(-time.Hour), now.Add(time.Hour)), expect: "trusted user CA"},
+		{name: "host certificate", key: newTestCertificate(t, ca, user, ssh.HostCert, "alice", now.Add(-time.Hour), now.Add(time.Hour)), expect: "not a user certificate"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := u.Authorize(tt.key)
+			if tt.expect == "" {
+				if err != nil {
+					t.Errorf("unexpected error - %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.expect) {
+				t.Errorf("expected error mentioning %q - got %v", tt.expect, err)
+			}
+		})
+	}
+}
+
+func TestUpstreamAuthorizePrincipals(t *testing.T) {
+	ca := newTestSigner(t)
+	user := newTestSigner(t)
+
+	u := &Upstream{
+		Username:          "alice",
+		TrustedUserCAKeys: []string{base64.StdEncoding.EncodeToString(ca.PublicKey().Marshal())},
+		Principals:        []string{"developers"},
+	}
+
+	now := time.Now()
+	if _, err := u.Authorize(newTestCertificate(t, ca, user, ssh.UserCert, "developers", now.Add(-time.Hour), now.Add(time.Hour))); err != nil {
+		t.Errorf("unexpected error - %v", err)
+	}
+	if _, err := u.Authorize(newTestCertificate(t, ca, user, ssh.UserCert, "alice", now.Add(-time.Hour), now.Add(time.Hour))); err == nil {
+		t.Errorf("expected the username to be replaced by the principals")
+	}
+}
+
+func TestUpstreamAuthorizeOptions(t *testing.T) {
+	ca := newTestSigner(t)
+	user := newTestSigner(t)
+
+	u := &Upstream{
+		Username:          "alice",
+		TrustedUserCAKeys: []string{base64.StdEncoding.EncodeToString(ca.PublicKey().Marshal())},
+	}
+
+	now := time.Now()
+	anyPrincipal := newTestCertificate(t, ca, user, ssh.UserCert, "", now.Add(-time.Hour), now.Add(time.Hour))
+	if _, err := u.Authorize(anyPrincipal); err == nil || !strings.Contains(err.Error(), "no principals") {
+		t.Errorf("expected a certificate without principals to be rejected - got %v", err)
+	}
+
+	restricted := newTestCertificate(t, ca, user, ssh.UserCert, "alice", now.Add(-time.Hour), now.Add(time.Hour))
+	restricted.CriticalOptions = map[string]string{"source-address": "10.0.0.0/8"}
+	if err := restricted.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("failed to sign certificate - %v", err)
+	}
+	permissions, err := u.Authorize(restricted)
+	if err != nil {
+		t.Fatalf("unexpected error - %v", err)
+	}
+	if permissions.CriticalOptions["source-address"] != "10.0.0.0/8" {
+		t.Errorf("expected the source-address option to be passed on - got %v", permissions.CriticalOptions)
+	}
+
+	forced := newTestCertificate(t, ca, user, ssh.UserCert, "alice", now.Add(-time.Hour), now.Add(time.Hour))
+	forced.CriticalOptions = map[string]string{"force-command": "true"}
+	if err := forced.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("failed to sign certificate - %v", err)
+	}
+	if _, err := u.Authorize(forced); err == nil {
+		t.Errorf("expected an unsupported critical option to be rejected")
+	}
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key - %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("failed to create signer - %v", err)
+	}
+	return signer
+}
+
+func newTestCertificate(t *testing.T, ca, user ssh.Signer, certType uint32, principal string, after, before time.Time) *ssh.Certificate {
+	t.Helper()
+	cert := &ssh.Certificate{
+		Key:         user.PublicKey(),
+		CertType:    certType,
+		ValidAfter:  uint64(after.Unix()),
+		ValidBefore: uint64(before.Unix()),
+	}
+	if principal != "" {
+		cert.ValidPrincipals = []string{principal}
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("failed to sign certificate - %v", err)
+	}
+	return cert
+}
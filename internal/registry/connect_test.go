@@ -0,0 +1,34 @@
+package registry
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestConnectDatabaseRetries(t *testing.T) {
+	// a port nothing listens on once the listener is closed
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	conf := DefaultConfig()
+	conf.Host = "127.0.0.1"
+	conf.Port = port
+	conf.ConnectRetries = 2
+	conf.ConnectBackoff = 10 * time.Millisecond
+	conf.QueryTimeout = time.Second
+
+	r := NewRegistry(zap.NewNop())
+	defer r.Close()
+	err = r.ConnectDatabase(conf)
+	if err == nil || !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Errorf("expected connecting to fail after 3 attempts - got %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package registry
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// privateKeyType is the algorithm of the private key stored in the type column, such as ssh-ed25519 or
+// ecdsa-sha2-nistp256. Keys which cannot be parsed are stored without a type, as they always were.
+func privateKeyType(data string) string {
+	signer, err := ssh.ParsePrivateKey([]byte(data))
+	if err != nil {
+		return ""
+	}
+	return signer.PublicKey().Type()
+}
+
+// publicKeyType is the algorithm of a public key in the base64 wire format sshpiper stores
+func publicKeyType(data string) string {
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return ""
+	}
+	key, err := ssh.ParsePublicKey(raw)
+	if err != nil {
+		return ""
+	}
+	return key.Type()
+}
+
+// VerifyHostKey checks the key presented by the container is one of the UpstreamHostKeys
+func (u *Upstream) VerifyHostKey(key ssh.PublicKey) error {
+	if containsKey(u.UpstreamHostKeys, key) {
+		return nil
+	}
+	return fmt.Errorf("host key %s is not pinned for upstream %s", ssh.FingerprintSHA256(key), u.Name)
+}
+
+// HostKeyAlgorithms of the UpstreamHostKeys, for the container to present one of them
+func (u *Upstream) HostKeyAlgorithms() []string {
+	var algorithms []string
+	for _, key := range u.UpstreamHostKeys {
+		if algorithm := publicKeyType(key); algorithm != "" {
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	return uniqueKeys(algorithms)
+}
+
+// uniqueKeys in their original order, without the repeated ones
+func uniqueKeys(keys []string) []string {
+	var unique []string
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,97 @@
+package registry
+
+import (
+	"database/sql"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Memory keeps upstreams in process for the embedded proxy, which resolves logins against it directly. Nothing
+// outlives the process, startup reconciliation registers every upstream again.
+type Memory struct {
+	logger *zap.Logger
+
+	mu sync.RWMutex
+	// upstreams by name and the name routed to by each username
+	upstreams map[string]*Upstream
+	usernames map[string]string
+}
+
+func NewMemory(logger *zap.Logger) *Memory {
+	return &Memory{
+		logger:    logger,
+		upstreams: map[string]*Upstream{},
+		usernames: map[string]string{},
+	}
+}
+
+// VerifiesCertificates is true as the embedded proxy authorizes logins through Upstream.Authorize
+func (m *Memory) VerifiesCertificates() bool {
+	return true
+}
+
+func (m *Memory) RegisterUpstream(upstream *Upstream) (*Upstream, error) {
+	if err := upstream.Validate(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if name, ok := m.usernames[upstream.Username]; ok && name != upstream.Name {
+		return nil, ErrUsernameTaken
+	}
+	if previous, ok := m.upstreams[upstream.Name]; ok {
+		delete(m.usernames, previous.Username)
+	}
+
+	// copied so that callers changing the upstream afterwards do not race with logins
+	stored := *upstream
+	m.upstreams[upstream.Name] = &stored
+	m.usernames[upstream.Username] = upstream.Name
+
+	m.logger.Info("Upstream registered", zap.String("name", upstream.Name), zap.String("username", upstream.Username))
+	return upstream, nil
+}
+
+// UnregisterUpstream returns sql.ErrNoRows for unknown upstreams, as for the MySQL registry
+func (m *Memory) UnregisterUpstream(upstream *Upstream) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.upstreams[upstream.Name]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.upstreams, stored.Name)
+	delete(m.usernames, stored.Username)
+
+	m.logger.Info("Upstream unregistered", zap.String("name", upstream.Name))
+	return nil
+}
+
+func (m *Memory) ListUpstreams() ([]*Upstream, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	upstreams := make([]*Upstream, 0, len(m.upstreams))
+	for _, u := range m.upstreams {
+		stored := *u
+		upstreams = append(upstreams, &stored)
+	}
+	return upstreams, nil
+}
+
+// Lookup the upstream routed to by a login name
+func (m *Memory) Lookup(username string) (*Upstream, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	name, ok := m.usernames[username]
+	if !ok {
+		return nil, false
+	}
+	stored := *m.upstreams[name]
+	return &stored, true
+}
@@ -0,0 +1,41 @@
+package registry
+
+import (
+	"database/sql"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestMemoryRegisterUpstream(t *testing.T) {
+	l, _ := zap.NewDevelopment()
+	m := NewMemory(l)
+
+	if _, err := m.RegisterUpstream(&Upstream{Name: "default-app", Username: "alice", UpstreamUsername: "root"}); err != nil {
+		t.Fatalf("unexpected error when registering - %v", err)
+	}
+	if _, err := m.RegisterUpstream(&Upstream{Name: "default-other", Username: "alice", UpstreamUsername: "root"}); err != ErrUsernameTaken {
+		t.Errorf("expected %v - got %v", ErrUsernameTaken, err)
+	}
+
+	// changing the username frees the previous one
+	if _, err := m.RegisterUpstream(&Upstream{Name: "default-app", Username: "carol", UpstreamUsername: "root"}); err != nil {
+		t.Fatalf("unexpected error when registering - %v", err)
+	}
+	if _, ok := m.Lookup("alice"); ok {
+		t.Errorf("expected the previous username to be released")
+	}
+	if u, ok := m.Lookup("carol"); !ok || u.Name != "default-app" {
+		t.Errorf("unexpected lookup - got %v, %v", u, ok)
+	}
+
+	if err := m.UnregisterUpstream(&Upstream{Name: "default-app"}); err != nil {
+		t.Errorf("unexpected error when unregistering - %v", err)
+	}
+	if err := m.UnregisterUpstream(&Upstream{Name: "default-app"}); err != sql.ErrNoRows {
+		t.Errorf("expected %v - got %v", sql.ErrNoRows, err)
+	}
+	if upstreams, _ := m.ListUpstreams(); len(upstreams) != 0 {
+		t.Errorf("expected no upstreams - got %v", upstreams)
+	}
+}
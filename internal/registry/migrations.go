@@ -0,0 +1,237 @@
+package registry
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"go.uber.org/zap"
+)
+
+// schemaVersionTable records the migrations applied to the database
+const schemaVersionTable = "ksce_schema_version"
+
+// migrationLock serializes migrations between replicas starting together
+const migrationLock = "ksce_schema_migration"
+
+// errNoSuchTable is the MySQL error number of a missing table
+const errNoSuchTable = 1146
+
+// migrationTimeout bounds waiting for the lock and applying the migrations, which may rebuild tables
+const migrationTimeout = 5 * time.Minute
+
+type migration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+// migrations in order of version. Applied migrations must never change, a change to the schema is a new migration.
+// MySQL commits each statement altering the schema on its own, so statements must be safe to run again should a
+// migration fail half way.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "sshpiper v0.3.1 mysql upstream schema",
+		statements: []string{
+			"create table if not exists `private_keys` (" +
+				"`id` int(11) not null auto_increment, " +
+				"`name` varchar(45) default null, " +
+				"`data` varchar(65000) not null, " +
+				"`type` varchar(45) not null, " +
+				"`gmt_create` datetime default current_timestamp, " +
+				"`gmt_modified` datetime default current_timestamp, " +
+				"primary key (`id`)" +
+				") engine=InnoDB default charset=utf8;",
+			"create table if not exists `public_keys` (" +
+				"`id` int(11) not null auto_increment, " +
+				"`name` varchar(45) default null, " +
+				"`data` varchar(65000) not null, " +
+				"`type` varchar(45) not null, " +
+				"`gmt_create` datetime default current_timestamp, " +
+				"`gmt_modified` datetime default current_timestamp, " +
+				"primary key (`id`)" +
+				") engine=InnoDB default charset=utf8;",
+			"create table if not exists `server` (" +
+				"`id` int(11) not null auto_increment, " +
+				"`name` varchar(45) default null, " +
+				"`address` varchar(100) not null, " +
+				"`gmt_create` datetime default current_timestamp, " +
+				"`gmt_modified` datetime default current_timestamp, " +
+				"primary key (`id`)" +
+				") engine=InnoDB default charset=utf8;",
+			"create table if not exists `upstream` (" +
+				"`id` int(11) not null auto_increment, " +
+				"`name` varchar(45) default null, " +
+				"`server_id` int(11) not null, " +
+				"`username` varchar(45) default null, " +
+				"`private_key_id` int(11) default null, " +
+				"`gmt_create` datetime default current_timestamp, " +
+				"`gmt_modified` datetime default current_timestamp, " +
+				"primary key (`id`), " +
+				"key `ser_id_idx` (`server_id`), " +
+				"constraint `ser_id` foreign key (`server_id`) references `server` (`id`) on delete no action on update no action" +
+				") engine=InnoDB default charset=utf8;",
+			"create table if not exists `pubkey_prikey_map` (" +
+				"`id` int(11) not null auto_increment, " +
+				"`private_key_id` int(11) not null, " +
+				"`pubkey_id` int(11) not null, " +
+				"`gmt_create` datetime default current_timestamp, " +
+				"`gmt_modified` datetime default current_timestamp, " +
+				"primary key (`id`), " +
+				"key `idx_pk_id` (`pubkey_id`), " +
+				"key `pri_key_id_idx` (`private_key_id`), " +
+				"constraint `pri_key_id` foreign key (`private_key_id`) references `private_keys` (`id`) on delete no action on update no action, " +
+				"constraint `pub_key_id` foreign key (`pubkey_id`) references `public_keys` (`id`) on delete no action on update no action" +
+				") engine=InnoDB default charset=utf8;",
+			"create table if not exists `pubkey_upstream_map` (" +
+				"`id` int(11) not null auto_increment, " +
+				"`upstream_id` int(11) not null, " +
+				"`pubkey_id` int(11) not null, " +
+				"`gmt_create` datetime default current_timestamp, " +
+				"`gmt_modified` datetime default current_timestamp, " +
+				"primary key (`id`), " +
+				"key `idx_pk_id` (`pubkey_id`), " +
+				"key `upstream_id_idx` (`upstream_id`), " +
+				"constraint `pubkey_id` foreign key (`pubkey_id`) references `public_keys` (`id`) on delete no action on update no action, " +
+				"constraint `upstream_id` foreign key (`upstream_id`) references `upstream` (`id`) on delete no action on update no action" +
+				") engine=InnoDB default charset=utf8;",
+			"create table if not exists `user_upstream_map` (" +
+				"`id` int(11) not null auto_increment, " +
+				"`upstream_id` int(11) not null, " +
+				"`username` varchar(45) not null, " +
+				"`gmt_create` datetime default current_timestamp, " +
+				"`gmt_modified` datetime default current_timestamp, " +
+				"primary key (`id`), " +
+				"key `idx_usr` (`username`), " +
+				"key `upstream_id_idx` (`upstream_id`), " +
+				"constraint `fx_upstream_id` foreign key (`upstream_id`) references `upstream` (`id`) on delete no action on update no action" +
+				") engine=InnoDB default charset=utf8;",
+		},
+	},
+}
+
+// schemaColumns read and written by the registry and by sshpiper, checked against the schema before starting
+var schemaColumns = map[string][]string{
+	"private_keys":        {"id", "name", "data", "type"},
+	"public_keys":         {"id", "name", "data", "type"},
+	"server":              {"id", "name", "address"},
+	"upstream":            {"id", "name", "server_id", "username", "private_key_id"},
+	"pubkey_prikey_map":   {"id", "private_key_id", "pubkey_id"},
+	"pubkey_upstream_map": {"id", "upstream_id", "pubkey_id"},
+	"user_upstream_map":   {"id", "upstream_id", "username"},
+}
+
+// SchemaVersion is the version of the schema this controller is built for
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// MigrateSchema creates the schema when missing and applies the migrations the database has not seen yet. A
+// schema created by the former Helm init script is adopted as version 1.
+func (r *Registry) MigrateSchema() error {
+	return r.withSchemaLock(func(ctx context.Context, conn *sql.Conn) error {
+		if _, err := conn.ExecContext(ctx, "create table if not exists "+schemaVersionTable+" ("+
+			"`version` int(11) not null, "+
+			"`description` varchar(255) not null, "+
+			"`applied_at` datetime default current_timestamp, "+
+			"primary key (`version`)"+
+			") engine=InnoDB default charset=utf8;"); err != nil {
+			return err
+		}
+
+		version, err := schemaVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if version > SchemaVersion() {
+			return fmt.Errorf("schema version %d is newer than version %d supported by this controller", version, SchemaVersion())
+		}
+
+		for _, m := range migrations {
+			if m.version <= version {
+				continue
+			}
+			r.logger.Info("Migrating schema", zap.Int("version", m.version), zap.String("description", m.description))
+			for _, statement := range m.statements {
+				if _, err = conn.ExecContext(ctx, statement); err != nil {
+					return fmt.Errorf("migration %d failed - %v", m.version, err)
+				}
+			}
+			if _, err = conn.ExecContext(ctx, "insert into "+schemaVersionTable+" (version, description) values (?, ?);", m.version, m.description); err != nil {
+				return err
+			}
+		}
+		return checkColumns(ctx, conn)
+	})
+}
+
+// CheckSchema fails unless the schema is at SchemaVersion, leaving migrations to be applied deliberately
+func (r *Registry) CheckSchema() error {
+	return r.withSchemaLock(func(ctx context.Context, conn *sql.Conn) error {
+		version, err := schemaVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if version < SchemaVersion() {
+			return fmt.Errorf("schema version %d is older than version %d, enable migrations to upgrade it", version, SchemaVersion())
+		}
+		if version > SchemaVersion() {
+			return fmt.Errorf("schema version %d is newer than version %d supported by this controller", version, SchemaVersion())
+		}
+		return checkColumns(ctx, conn)
+	})
+}
+
+// withSchemaLock runs fn holding a MySQL named lock, which belongs to the connection it was taken on
+func (r *Registry) withSchemaLock(fn func(ctx context.Context, conn *sql.Conn) error) error {
+	ctx, cancel := context.WithTimeout(r.ctx, migrationTimeout)
+	defer cancel()
+
+	conn, err := r.database.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var locked sql.NullInt64
+	if err = conn.QueryRowContext(ctx, "select get_lock(?, ?);", migrationLock, int(migrationTimeout.Seconds())).Scan(&locked); err != nil {
+		return err
+	}
+	if locked.Int64 != 1 {
+		return errors.New("timed out waiting for another replica to migrate the schema")
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), "select release_lock(?);", migrationLock); err != nil {
+			r.logger.Warn("Failed to release the schema lock", zap.Error(err))
+		}
+	}()
+
+	return fn(ctx, conn)
+}
+
+// schemaVersion of the database, 0 when no migration was applied
+func schemaVersion(ctx context.Context, conn *sql.Conn) (int, error) {
+	var version sql.NullInt64
+	err := conn.QueryRowContext(ctx, "select max(version) from "+schemaVersionTable+";").Scan(&version)
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == errNoSuchTable {
+		return 0, nil
+	}
+	return int(version.Int64), err
+}
+
+// checkColumns selects the columns in use from every table, failing on a schema which does not match them
+func checkColumns(ctx context.Context, conn *sql.Conn) error {
+	for table, columns := range schemaColumns {
+		rows, err := conn.QueryContext(ctx, fmt.Sprintf("select %s from %s limit 0;", strings.Join(columns, ", "), table))
+		if err != nil {
+			return fmt.Errorf("schema does not match table %s - %v", table, err)
+		}
+		rows.Close()
+	}
+	return nil
+}
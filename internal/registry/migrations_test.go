@@ -0,0 +1,34 @@
+package registry
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMigrationsOrdered(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("expected migration %d to have version %d - got %d", i, i+1, m.version)
+		}
+		if m.description == "" || len(m.statements) == 0 {
+			t.Errorf("expected migration %d to be described and have statements", m.version)
+		}
+	}
+	if SchemaVersion() != len(migrations) {
+		t.Errorf("expected schema version %d - got %d", len(migrations), SchemaVersion())
+	}
+}
+
+func TestMigrationsCreateTables(t *testing.T) {
+	for table := range schemaColumns {
+		var created bool
+		for _, m := range migrations {
+			for _, statement := range m.statements {
+				created = created || strings.HasPrefix(statement, "create table if not exists `"+table+"`")
+			}
+		}
+		if !created {
+			t.Errorf("expected a migration to create table %s", table)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// tlsConfigName the TLS config is registered with the driver under
+const tlsConfigName = "ksce"
+
+// TLSConfig of the connections to MySQL
+type TLSConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// CAFile verifies the server certificate instead of the system roots
+	CAFile string `yaml:"caFile" split_words:"true"`
+	// CertFile and KeyFile hold the client certificate, for users which require X509
+	CertFile string `yaml:"certFile" split_words:"true"`
+	KeyFile  string `yaml:"keyFile" split_words:"true"`
+	// ServerName in the server certificate, defaulting to the host
+	ServerName string `yaml:"serverName" split_words:"true"`
+}
+
+// connector opens connections with the password read from passwordFile when set, so that connections opened after
+// the file is rotated use the new password
+type connector struct {
+	conf         *mysql.Config
+	passwordFile string
+}
+
+func newConnector(conf Config) (*connector, error) {
+	c := mysql.NewConfig()
+	c.User = conf.User
+	c.Passwd = conf.Password
+	c.Net = "tcp"
+	c.Addr = net.JoinHostPort(conf.Host, strconv.Itoa(conf.Port))
+	c.DBName = conf.Database
+	c.Timeout = conf.QueryTimeout
+
+	if conf.TLS.Enabled {
+		tlsConfig, err := newTLSConfig(conf.TLS, conf.Host)
+		if err != nil {
+			return nil, err
+		}
+		if err = mysql.RegisterTLSConfig(tlsConfigName, tlsConfig); err != nil {
+			return nil, err
+		}
+		c.TLSConfig = tlsConfigName
+	}
+
+	if conf.PasswordFile != "" {
+		// fail early on a missing file rather than on the first connection
+		if _, err := readPassword(conf.PasswordFile); err != nil {
+			return nil, err
+		}
+	}
+	return &connector{conf: c, passwordFile: conf.PasswordFile}, nil
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	conf := *c.conf
+	if c.passwordFile != "" {
+		password, err := readPassword(c.passwordFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Passwd = password
+	}
+	return c.Driver().Open(conf.FormatDSN())
+}
+
+func (c *connector) Driver() driver.Driver {
+	return mysql.MySQLDriver{}
+}
+
+// readPassword from a file such as a mounted Secret key, without the trailing newline editors add
+func readPassword(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read MySQL password - %v", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+func newTLSConfig(conf TLSConfig, host string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: conf.ServerName}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+
+	if conf.CAFile != "" {
+		pem, err := ioutil.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", conf.CAFile)
+		}
+	}
+
+	if conf.CertFile != "" || conf.KeyFile != "" {
+		if conf.CertFile == "" || conf.KeyFile == "" {
+			return nil, errors.New("a client certificate requires both a certificate and a key file")
+		}
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
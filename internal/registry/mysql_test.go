@@ -0,0 +1,70 @@
+package registry
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestConnectorEscapesPassword(t *testing.T) {
+	conf := DefaultConfig()
+	conf.User = "ksce"
+	conf.Password = "p@ss/w:rd?"
+
+	c, err := newConnector(conf)
+	if err != nil {
+		t.Fatalf("unexpected error - %v", err)
+	}
+
+	parsed, err := mysql.ParseDSN(c.conf.FormatDSN())
+	if err != nil {
+		t.Fatalf("unexpected error parsing DSN - %v", err)
+	}
+	if parsed.User != conf.User || parsed.Passwd != conf.Password || parsed.Addr != "localhost:3306" || parsed.DBName != conf.Database {
+		t.Errorf("expected the DSN to round trip - got %+v", parsed)
+	}
+}
+
+func TestReadPasswordRotation(t *testing.T) {
+	f, err := ioutil.TempFile("", "ksce-mysql-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	for _, password := range []string{"first", "rotated"} {
+		if err = ioutil.WriteFile(f.Name(), []byte(password+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readPassword(f.Name())
+		if err != nil {
+			t.Fatalf("unexpected error - %v", err)
+		}
+		if got != password {
+			t.Errorf("expected %q - got %q", password, got)
+		}
+	}
+
+	conf := DefaultConfig()
+	conf.PasswordFile = f.Name() + ".missing"
+	if _, err = newConnector(conf); err == nil {
+		t.Errorf("expected a missing password file to fail")
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	tlsConfig, err := newTLSConfig(TLSConfig{Enabled: true}, "mysql.example")
+	if err != nil {
+		t.Fatalf("unexpected error - %v", err)
+	}
+	if tlsConfig.ServerName != "mysql.example" {
+		t.Errorf("expected the server name to default to the host - got %q", tlsConfig.ServerName)
+	}
+
+	if _, err = newTLSConfig(TLSConfig{Enabled: true, CertFile: "client-cert.pem"}, "mysql.example"); err == nil {
+		t.Errorf("expected a certificate without a key to fail")
+	}
+}
@@ -1,299 +1,372 @@
 package registry
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"regexp"
+	"time"
 
-	_ "github.com/go-sql-driver/mysql"
-	"github.com/kelseyhightower/envconfig"
-	"github.com/tg123/sshpiper/sshpiperd/upstream/mysql/crud"
 	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
 type Registrable interface {
 	RegisterUpstream(upstream *Upstream) (*Upstream, error)
 	UnregisterUpstream(upstream *Upstream) error
+	ListUpstreams() ([]*Upstream, error)
+}
+
+// Pinger is implemented by backends which depend on a service which may become unreachable
+type Pinger interface {
+	Ping() error
+}
+
+// Ping checks that r can be reached, backends without a Pinger always can
+func Ping(r Registrable) error {
+	if p, ok := r.(Pinger); ok {
+		return p.Ping()
+	}
+	return nil
+}
+
+// Closer is implemented by backends holding connections which must be released on shutdown
+type Closer interface {
+	Close() error
+}
+
+// Close r, backends without a Closer have nothing to release
+func Close(r Registrable) error {
+	if c, ok := r.(Closer); ok {
+		return c.Close()
+	}
+	return nil
 }
 
 type Registry struct {
 	logger   *zap.Logger
 	database *sql.DB
+	// ctx bounds every transaction, cancelling it rolls back those in flight
+	ctx          context.Context
+	cancel       context.CancelFunc
+	queryTimeout time.Duration
 }
 
+// Config of the MySQL database, set through the KSCE_MYSQL_* env vars or the mysql section of the config file
 type Config struct {
-	Port     int    `default:"3306"`
-	Host     string `default:"localhost"`
-	User     string `default:"root"`
-	Password string `default:""`
-	Database string `default:"sshpiper"`
+	Port     int    `yaml:"port"`
+	Host     string `yaml:"host"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	// PasswordFile is read instead of Password whenever a connection is opened, so that a rotated password mounted
+	// from a Secret is picked up without a restart
+	PasswordFile string    `yaml:"passwordFile" split_words:"true"`
+	Database     string    `yaml:"database"`
+	TLS          TLSConfig `yaml:"tls"`
+	// ConnectRetries is how many times the startup ping is retried, doubling ConnectBackoff after each attempt
+	ConnectRetries int           `yaml:"connectRetries" split_words:"true"`
+	ConnectBackoff time.Duration `yaml:"connectBackoff" split_words:"true"`
+	MaxOpenConns   int           `yaml:"maxOpenConns" split_words:"true"`
+	MaxIdleConns   int           `yaml:"maxIdleConns" split_words:"true"`
+	// ConnMaxLifetime recycles connections, so that those to a rescheduled MySQL pod are not kept for long
+	ConnMaxLifetime time.Duration `yaml:"connMaxLifetime" split_words:"true"`
+	// QueryTimeout bounds each query, and each registration as a whole as it runs in a single transaction
+	QueryTimeout time.Duration `yaml:"queryTimeout" split_words:"true"`
+	// Migrate creates the schema and applies migrations on connecting, otherwise starting fails unless the schema
+	// is already at the version this controller is built for
+	Migrate bool `yaml:"migrate"`
 }
 
+func DefaultConfig() Config {
+	return Config{
+		Port:            3306,
+		Host:            "localhost",
+		User:            "ksce",
+		Database:        "sshpiper",
+		ConnectRetries:  5,
+		ConnectBackoff:  time.Second,
+		MaxOpenConns:    10,
+		MaxIdleConns:    5,
+		ConnMaxLifetime: 5 * time.Minute,
+		QueryTimeout:    10 * time.Second,
+		Migrate:         true,
+	}
+}
+
+// ErrUsernameTaken is returned when registering an upstream with a username already routed to another upstream
+var ErrUsernameTaken = errors.New("username is already registered to another upstream")
+
+// maxColumnLength is the size of the sshpiper name and username columns
+const maxColumnLength = 45
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]*$`)
+
 type Upstream struct {
-	Name                string
-	Username            string
+	Name string
+	// Username is the name used to log in through sshpiper, ssh -l {Username}
+	Username string
+	// UpstreamUsername is the user sshpiper logs in to the container as
+	UpstreamUsername    string
 	Address             string
 	SSHPiperPrivateKey  string
 	DownstreamPublicKey []string
+	// TrustedUserCAKeys sign user certificates accepted for one of the Principals, in the same format as
+	// DownstreamPublicKey. Only backends implementing CertificateVerifier enforce them.
+	TrustedUserCAKeys []string
+	// Principals accepted in certificates, defaulting to Username
+	Principals []string
+	// UpstreamHostKeys the container may present, in the same format as DownstreamPublicKey. Only the embedded
+	// proxy verifies them.
+	UpstreamHostKeys []string
+}
+
+// Validate the upstream fits the sshpiper schema
+func (u *Upstream) Validate() error {
+	if len(u.Name) > maxColumnLength {
+		return fmt.Errorf("name %q exceeds %d characters", u.Name, maxColumnLength)
+	}
+	for field, username := range map[string]string{"username": u.Username, "upstream username": u.UpstreamUsername} {
+		if len(username) > maxColumnLength {
+			return fmt.Errorf("%s %q exceeds %d characters", field, username, maxColumnLength)
+		}
+		if !usernamePattern.MatchString(username) {
+			return fmt.Errorf("%s %q is not a valid username", field, username)
+		}
+	}
+	return nil
 }
 
 func NewRegistry(logger *zap.Logger) *Registry {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Registry{
 		logger: logger,
+		ctx:    ctx,
+		cancel: cancel,
 	}
 }
 
-func (r *Registry) ConnectDatabase() error {
-	var conf Config
-	var err error
-	err = envconfig.Process("KSCE_MYSQL", &conf)
+// ConnectDatabase opens the connection pool and waits for MySQL to answer a ping, retrying with an exponential
+// backoff as MySQL may still be starting, then migrates or checks the schema. Once connected, connections lost to a
+// MySQL restart are replaced by the pool on the next query.
+func (r *Registry) ConnectDatabase(conf Config) error {
+	r.logger.Info("MySQL Config", zap.String("user", conf.User), zap.String("host", conf.Host), zap.Int("port", conf.Port), zap.String("database", conf.Database), zap.Bool("tls", conf.TLS.Enabled))
+	connector, err := newConnector(conf)
 	if err != nil {
 		return err
 	}
-	r.logger.Info("MySQL Config", zap.String("user", conf.User), zap.String("host", conf.Host), zap.Int("port", conf.Port), zap.String("database", conf.Database))
-	source := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", conf.User, conf.Password, conf.Host, conf.Port, conf.Database)
-	r.database, err = sql.Open("mysql", source)
-	return err
+	r.database = sql.OpenDB(connector)
+	r.database.SetMaxOpenConns(conf.MaxOpenConns)
+	r.database.SetMaxIdleConns(conf.MaxIdleConns)
+	r.database.SetConnMaxLifetime(conf.ConnMaxLifetime)
+	r.queryTimeout = conf.QueryTimeout
+
+	backoff := wait.Backoff{Duration: conf.ConnectBackoff, Factor: 2, Steps: conf.ConnectRetries + 1}
+	if waitErr := wait.ExponentialBackoff(backoff, func() (bool, error) {
+		if err = r.Ping(); err != nil {
+			r.logger.Warn("MySQL is not reachable", zap.Error(err))
+			return false, nil
+		}
+		return true, nil
+	}); waitErr != nil {
+		return fmt.Errorf("MySQL is not reachable after %d attempts - %v", backoff.Steps, err)
+	}
+
+	if conf.Migrate {
+		return r.MigrateSchema()
+	}
+	return r.CheckSchema()
 }
 
 func (r *Registry) IsConnected() bool {
 	return r.database != nil
 }
 
-func (r *Registry) truncate(table string, hasForeignKey bool, ignoreForeignKeyChecks bool) error {
-	var tx *sql.Tx
-	var err error
-	if tx, err = r.database.Begin(); err != nil {
-		return err
+// Ping the database, opening a connection when the pool has none
+func (r *Registry) Ping() error {
+	if !r.IsConnected() {
+		return errors.New("database is not connected")
 	}
-	if hasForeignKey && ignoreForeignKeyChecks {
-		if _, err = tx.Exec("set foreign_key_checks = 0;"); err != nil {
-			return err
-		}
-	}
-	if _, err = tx.Exec(fmt.Sprintf("truncate table %s;", table)); err != nil {
-		return err
-	}
-	if hasForeignKey && ignoreForeignKeyChecks {
-		if _, err = tx.Exec("set foreign_key_checks = 1;"); err != nil {
-			return err
-		}
+	ctx, cancel := r.withTimeout()
+	defer cancel()
+	return r.database.PingContext(ctx)
+}
+
+// withTimeout bounds a query, or a transaction, by the query timeout
+func (r *Registry) withTimeout() (context.Context, context.CancelFunc) {
+	if r.queryTimeout <= 0 {
+		return context.WithCancel(r.ctx)
 	}
-	return tx.Commit()
+	return context.WithTimeout(r.ctx, r.queryTimeout)
 }
 
-func (r *Registry) TruncateAll() error {
-	var err error
-	type table struct {
-		name          string
-		hasForeignKey bool
-	}
-	tables := []table{
-		{"pubkey_prikey_map", false},
-		{"pubkey_upstream_map", false},
-		{"user_upstream_map", false},
-		{"private_keys", true},
-		{"public_keys", true},
-		{"server", true},
-		{"upstream", true},
-	}
-	for _, table := range tables {
-		if err = r.truncate(table.name, table.hasForeignKey, table.hasForeignKey); err != nil {
-			return err
-		}
+// Close rolls back the transactions still in flight and closes the database, waiting for queries already sent to
+// the server
+func (r *Registry) Close() error {
+	r.cancel()
+	if !r.IsConnected() {
+		return nil
 	}
-	r.logger.Info("Database truncated")
-	return nil
+	return r.database.Close()
 }
 
+// RegisterUpstream creates or updates the upstream keyed by its name. Stored state is compared against the
+// upstream so that a changed address or private key is updated in place and public keys are added or removed
+// individually rather than appended on every call.
 func (r *Registry) RegisterUpstream(upstream *Upstream) (*Upstream, error) {
-	var err error
-	var serverID int64
-	var upstreamID int64
-	var privateKeyID int64
-	var publicKeyID int64
-
-	s := crud.NewServer(r.database)
-	if rec, err := s.GetFirstByAddress(upstream.Address); err == nil {
-		if rec != nil {
-			serverID = rec.Id
-		} else {
-			if serverID, err = s.Post(&crud.ServerRecord{Name: upstream.Name, Address: upstream.Address}); err == nil {
-				err = s.Commit()
-			} else {
-				err = s.Rollback()
-			}
+	err := r.inTransaction(func(tx *sql.Tx) error {
+		// a username can only route to a single upstream across the cluster
+		_, err := selectID(tx, "select uum.`id` from `user_upstream_map` uum "+
+			"join `upstream` u on u.`id` = uum.`upstream_id` "+
+			"join `server` s on s.`id` = u.`server_id` "+
+			"where uum.`username` = ? and s.`name` <> ? limit 1;", upstream.Username, upstream.Name)
+		if err == nil {
+			return ErrUsernameTaken
 		}
-	}
-	if err != nil {
-		return nil, err
-	}
-
-	u := crud.NewUpstream(r.database)
-	if rec, err := u.GetFirstByServerId(serverID); err == nil {
-		if rec != nil {
-			upstreamID = rec.Id
-		} else {
-			if upstreamID, err = u.Post(&crud.UpstreamRecord{Name: upstream.Name, ServerId: serverID, Username: upstream.Name}); err == nil {
-				err = u.Commit()
-			} else {
-				err = u.Rollback()
-			}
+		if err != sql.ErrNoRows {
+			return err
 		}
-	}
-	if err != nil {
-		return nil, err
-	}
 
-	uum := crud.NewUserUpstreamMap(r.database)
-	if rec, err := uum.GetFirstByUpstreamId(upstreamID); err == nil && rec == nil {
-		if _, err = uum.Post(&crud.UserUpstreamMapRecord{UpstreamId: upstreamID, Username: upstream.Username}); err == nil {
-			err = uum.Commit()
-		} else {
-			err = uum.Rollback()
+		serverID, err := upsert(tx,
+			"select `id` from `server` where `name` = ? limit 1;", []interface{}{upstream.Name},
+			"insert into `server` set `name` = ?, `address` = ?, `gmt_modified` = now(), `gmt_create` = now();", []interface{}{upstream.Name, upstream.Address},
+			"update `server` set `address` = ?, `gmt_modified` = now() where `id` = ?;", []interface{}{upstream.Address},
+		)
+		if err != nil {
+			return err
 		}
-	}
-	if err != nil {
-		return nil, err
-	}
 
-	prv := crud.NewPrivateKeys(r.database)
-	if rec, err := prv.GetFirstByName(upstream.Name); err == nil {
-		if rec != nil {
-			privateKeyID = rec.Id
-		} else {
-			if privateKeyID, err = prv.Post(&crud.PrivateKeysRecord{Name: upstream.Name, Data: upstream.SSHPiperPrivateKey}); err == nil {
-				err = prv.Commit()
-			} else {
-				err = prv.Rollback()
-			}
+		upstreamID, err := upsert(tx,
+			"select `id` from `upstream` where `server_id` = ? limit 1;", []interface{}{serverID},
+			"insert into `upstream` set `name` = ?, `server_id` = ?, `username` = ?, `private_key_id` = 0, `gmt_modified` = now(), `gmt_create` = now();", []interface{}{upstream.Name, serverID, upstream.UpstreamUsername},
+			"update `upstream` set `username` = ?, `gmt_modified` = now() where `id` = ?;", []interface{}{upstream.UpstreamUsername},
+		)
+		if err != nil {
+			return err
 		}
-	}
-	if err != nil {
-		r.logger.Info("Error")
-		r.logger.Info(err.Error())
-		return nil, err
-	}
 
-	for i := range upstream.DownstreamPublicKey {
-		r.logger.Info("New DownstreamPublicKey")
-		r.logger.Info(upstream.DownstreamPublicKey[i])
-		pub := crud.NewPublicKeys(r.database)
-		// if rec, err := pub.GetFirstByName(upstream.Name); err == nil {
-		// if rec != nil {
-		//	publicKeyID = rec.Id
-		//	logger.Info("Key Fetched")
-		// } else {
-		if publicKeyID, err = pub.Post(&crud.PublicKeysRecord{Name: upstream.Name, Data: upstream.DownstreamPublicKey[i]}); err == nil {
-			err = pub.Commit()
-			r.logger.Info("Key Added")
-			r.logger.Info(upstream.DownstreamPublicKey[i])
-		} else {
-			r.logger.Info(err.Error())
-			err = pub.Rollback()
-		}
-		// }
-		// }
+		_, err = upsert(tx,
+			"select `id` from `user_upstream_map` where `upstream_id` = ? limit 1;", []interface{}{upstreamID},
+			"insert into `user_upstream_map` set `upstream_id` = ?, `username` = ?, `gmt_modified` = now(), `gmt_create` = now();", []interface{}{upstreamID, upstream.Username},
+			"update `user_upstream_map` set `username` = ?, `gmt_modified` = now() where `id` = ?;", []interface{}{upstream.Username},
+		)
 		if err != nil {
-			r.logger.Info(err.Error())
-			return nil, err
+			return err
 		}
 
-		ppm := crud.NewPubkeyPrikeyMap(r.database)
-		// if rec, err := ppm.GetFirstByPrivateKeyId(privateKeyID); err == nil && rec == nil {
-		if _, err = ppm.Post(&crud.PubkeyPrikeyMapRecord{PrivateKeyId: privateKeyID, PubkeyId: publicKeyID}); err == nil {
-			err = ppm.Commit()
-			r.logger.Info("Key Map Added")
-		} else {
-			err = ppm.Rollback()
+		privateKeyID, err := upsert(tx,
+			"select `id` from `private_keys` where `name` = ? limit 1;", []interface{}{upstream.Name},
+			"insert into `private_keys` set `name` = ?, `data` = ?, `type` = ?, `gmt_modified` = now(), `gmt_create` = now();", []interface{}{upstream.Name, upstream.SSHPiperPrivateKey, privateKeyType(upstream.SSHPiperPrivateKey)},
+			"update `private_keys` set `data` = ?, `type` = ?, `gmt_modified` = now() where `id` = ?;", []interface{}{upstream.SSHPiperPrivateKey, privateKeyType(upstream.SSHPiperPrivateKey)},
+		)
+		if err != nil {
+			return err
 		}
-		// }
-		// if err != nil {
-		// 	return nil, err
-		// }
-		r.logger.Info("-")
-	}
-
-	r.logger.Info("Upstream registered", zap.String("name", upstream.Name), zap.String("username", upstream.Username))
-
-	if err != nil {
-		r.logger.Info("Error!")
-		r.logger.Info(err.Error())
-	}
-	
-	return nil, err
-}
-
-func (r *Registry) UnregisterUpstream(upstream *Upstream) error {
-	// note the get{x}Record functions are expected to return values which make it safe
-	// to assume not nil on the record after checking the err is not nil. This allows us to reduce
-	// the verbosity of the code here. These functions are also expected to set sentinel errors from sql
-	// for no rows found so that the caller can make informed decisions on how they will handle the failure.
 
-	s, serverRec, err := r.getServerRecord(upstream.Name)
+		return r.syncPublicKeys(tx, upstream, privateKeyID)
+	})
 	if err != nil {
-		return err
-	}
-
-	u, upstreamRec, err := r.getUpstreamRecord(serverRec.Id)
-	if err != nil {
-		return err
-	}
-
-	um, upstreamUserMap, err := r.getUpstreamUserMapRecord(upstreamRec.Id)
-	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// respect constraints and delete in reverse
-	err = r.deleteUpstreamUserMapRecord(um, upstreamUserMap)
-	if err != nil {
-		return err
-	}
+	r.logger.Info("Upstream registered", zap.String("name", upstream.Name), zap.String("username", upstream.Username))
+	return upstream, nil
+}
 
-	err = r.deleteUpstreamRecord(u, upstreamRec)
+// syncPublicKeys adds the public keys of the upstream which are not yet stored and removes those which are no
+// longer present, leaving unchanged keys untouched. Each key is stored once, further rows of the same key are
+// removed too.
+func (r *Registry) syncPublicKeys(tx *sql.Tx, upstream *Upstream, privateKeyID int64) error {
+	rows, err := tx.Query("select `id`, `data` from `public_keys` where `name` = ? order by `id`;", upstream.Name)
 	if err != nil {
 		return err
 	}
-
-	err = r.deleteServerRecord(s, serverRec)
-	if err != nil {
-		return err
+	stored := make(map[string][]int64)
+	for rows.Next() {
+		var id int64
+		var data string
+		if err = rows.Scan(&id, &data); err != nil {
+			rows.Close()
+			return err
+		}
+		stored[data] = append(stored[data], id)
 	}
-
-	// cleaning up keys and mappings
-	privateKey, pkRec, err := r.getPrivateKeys(upstream.Name)
-	if err != nil {
+	rows.Close()
+	if err = rows.Err(); err != nil {
 		return err
 	}
 
-	pubPrivKeyMap, ppkRec, err := r.getPublicPrivateKeyMap(pkRec.Id)
-	if err != nil {
-		return err
+	var removed []int64
+	for _, key := range uniqueKeys(upstream.DownstreamPublicKey) {
+		if ids, ok := stored[key]; ok {
+			// the first row is kept, any others are duplicates
+			removed = append(removed, ids[1:]...)
+			delete(stored, key)
+			continue
+		}
+		publicKeyID, err := insert(tx, "insert into `public_keys` set `name` = ?, `data` = ?, `type` = ?, `gmt_modified` = now(), `gmt_create` = now();",
+			upstream.Name, key, publicKeyType(key))
+		if err != nil {
+			return err
+		}
+		_, err = insert(tx, "insert into `pubkey_prikey_map` set `private_key_id` = ?, `pubkey_id` = ?, `gmt_modified` = now(), `gmt_create` = now();",
+			privateKeyID, publicKeyID)
+		if err != nil {
+			return err
+		}
+		r.logger.Debug("Public key added", zap.String("name", upstream.Name))
 	}
 
-	// get the list of public keys associated with the name
-	publicKeys, pubKeyRec, err := r.getPublicKeys(upstream.Name)
-	if err != nil {
-		return err
+	// anything left over has been removed from the upstream
+	for _, ids := range stored {
+		removed = append(removed, ids...)
 	}
-
-	errs := r.deletePublicPrivateKeyMap(pubPrivKeyMap, ppkRec)
-	if len(errs) > 0 {
-		for _, e := range errs {
-			r.logger.Sugar().Errorf("error deleting entry from 'pubkey_prikey_map' - %v", e)
+	for _, id := range removed {
+		if _, err = tx.Exec("delete from `pubkey_prikey_map` where `pubkey_id` = ?;", id); err != nil {
+			return err
 		}
-		return fmt.Errorf("failed to delete some required entries")
-	}
-
-	errs = r.deletePublicKeyRecords(publicKeys, pubKeyRec)
-	if len(errs) > 0 {
-		for _, e := range errs {
-			r.logger.Sugar().Errorf("error deleting entry from 'public_keys' - %v", e)
+		if _, err = tx.Exec("delete from `public_keys` where `id` = ?;", id); err != nil {
+			return err
 		}
-		return fmt.Errorf("failed to delete some required entries")
+		r.logger.Debug("Public key removed", zap.String("name", upstream.Name))
 	}
+	return nil
+}
 
-	err = r.deletePrivateKeyRecord(privateKey, pkRec)
+// UnregisterUpstream deletes the rows of the upstream by name from every table, so that the rows of an upstream
+// left partially written are cleaned up too. sql.ErrNoRows is returned when there was nothing to delete, so that the
+// caller can make informed decisions on how they will handle it.
+func (r *Registry) UnregisterUpstream(upstream *Upstream) error {
+	// any failure rolls back every delete made before it
+	err := r.inTransaction(func(tx *sql.Tx) error {
+		// respect constraints and delete in reverse, any of the rows may be missing
+		statements := []string{
+			"delete uum from `user_upstream_map` uum join `upstream` u on u.`id` = uum.`upstream_id` join `server` s on s.`id` = u.`server_id` where s.`name` = ?;",
+			"delete pum from `pubkey_upstream_map` pum join `upstream` u on u.`id` = pum.`upstream_id` join `server` s on s.`id` = u.`server_id` where s.`name` = ?;",
+			"delete u from `upstream` u join `server` s on s.`id` = u.`server_id` where s.`name` = ?;",
+			"delete from `server` where `name` = ?;",
+			"delete ppm from `pubkey_prikey_map` ppm join `private_keys` pk on pk.`id` = ppm.`private_key_id` where pk.`name` = ?;",
+			"delete ppm from `pubkey_prikey_map` ppm join `public_keys` pk on pk.`id` = ppm.`pubkey_id` where pk.`name` = ?;",
+			"delete from `public_keys` where `name` = ?;",
+			"delete from `private_keys` where `name` = ?;",
+		}
+		var deleted int64
+		for _, statement := range statements {
+			res, err := tx.Exec(statement, upstream.Name)
+			if err != nil {
+				return err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			deleted += n
+		}
+		if deleted == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
@@ -302,170 +375,122 @@ func (r *Registry) UnregisterUpstream(upstream *Upstream) error {
 	return nil
 }
 
-func (r *Registry) getServerRecord(name string) (*crud.Server, *crud.ServerRecord, error) {
-	s := crud.NewServer(r.database)
-	rec, err := s.GetFirstByName(name)
+// ListUpstreams returns every upstream currently registered along with its keys, allowing callers to diff
+// the database against the cluster. Server rows left without an upstream are listed with empty usernames, so that
+// they are either completed or removed.
+func (r *Registry) ListUpstreams() ([]*Upstream, error) {
+	ctx, cancel := r.withTimeout()
+	defer cancel()
+	rows, err := r.database.QueryContext(ctx, "select s.name, s.address, uum.username, u.username from server s "+
+		"left join upstream u on u.server_id = s.id "+
+		"left join user_upstream_map uum on uum.upstream_id = u.id "+
+		"order by s.id;")
 	if err != nil {
-		return s, nil, err
-	}
-	if rec == nil {
-		err = sql.ErrNoRows
-		return s, nil, err
+		return nil, err
 	}
-	return s, rec, nil
-}
+	defer rows.Close()
 
-func (r *Registry) getUpstreamRecord(serverID int64) (*crud.Upstream, *crud.UpstreamRecord, error) {
-	u := crud.NewUpstream(r.database)
-	rec, err := u.GetFirstByServerId(serverID)
-	if err != nil {
-		return u, nil, err
-	}
-	if rec == nil {
-		err = sql.ErrNoRows
-		return u, nil, err
+	var upstreams []*Upstream
+	for rows.Next() {
+		var name, address, username, upstreamUsername sql.NullString
+		if err = rows.Scan(&name, &address, &username, &upstreamUsername); err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, &Upstream{
+			Name:             name.String,
+			Username:         username.String,
+			UpstreamUsername: upstreamUsername.String,
+			Address:          address.String,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
 	}
-	return u, rec, nil
-}
 
-func (r *Registry) getUpstreamUserMapRecord(upstreamID int64) (*crud.UserUpstreamMap, *crud.UserUpstreamMapRecord, error) {
-	u := crud.NewUserUpstreamMap(r.database)
-	rec, err := u.GetFirstByUpstreamId(upstreamID)
-	if err != nil {
-		return u, nil, err
-	}
-	if rec == nil {
-		err = sql.ErrNoRows
-		return u, nil, err
-	}
-	return u, rec, nil
-}
+	for _, upstream := range upstreams {
+		prvs, err := r.selectData("select data from private_keys where name = ? order by id limit 1;", upstream.Name)
+		if err != nil {
+			return nil, err
+		}
+		if len(prvs) > 0 {
+			upstream.SSHPiperPrivateKey = prvs[0]
+		}
 
-func (r *Registry) getPublicKeys(upstream string) (*crud.PublicKeys, []*crud.PublicKeysRecord, error) {
-	pk := crud.NewPublicKeys(r.database)
-	rec, err := pk.GetByName(upstream)
-	if err != nil {
-		return pk, nil, err
-	}
-	if rec == nil {
-		err = sql.ErrNoRows
-		return pk, nil, err
+		if upstream.DownstreamPublicKey, err = r.selectData("select data from public_keys where name = ? order by id;", upstream.Name); err != nil {
+			return nil, err
+		}
 	}
-	return pk, rec, nil
+	return upstreams, nil
 }
 
-func (r *Registry) getPrivateKeys(upstream string) (*crud.PrivateKeys, *crud.PrivateKeysRecord, error) {
-	pk := crud.NewPrivateKeys(r.database)
-	rec, err := pk.GetFirstByName(upstream)
+// selectData returns the data column of the key rows matched by the query
+func (r *Registry) selectData(query string, args ...interface{}) ([]string, error) {
+	ctx, cancel := r.withTimeout()
+	defer cancel()
+	rows, err := r.database.QueryContext(ctx, query, args...)
 	if err != nil {
-		return pk, nil, err
-	}
-	if rec == nil {
-		err = sql.ErrNoRows
-		return pk, nil, err
+		return nil, err
 	}
-	return pk, rec, nil
-}
+	defer rows.Close()
 
-func (r *Registry) getPublicPrivateKeyMap(privateKeyID int64) (*crud.PubkeyPrikeyMap, []*crud.PubkeyPrikeyMapRecord, error) {
-	ppk := crud.NewPubkeyPrikeyMap(r.database)
-	rec, err := ppk.GetByPrivateKeyId(privateKeyID)
-	if err != nil {
-		return ppk, nil, err
-	}
-	if rec == nil {
-		err = sql.ErrNoRows
-		return ppk, nil, err
+	var data []string
+	for rows.Next() {
+		var d string
+		if err = rows.Scan(&d); err != nil {
+			return nil, err
+		}
+		data = append(data, d)
 	}
-	return ppk, rec, nil
+	return data, rows.Err()
 }
 
-func (r *Registry) deleteServerRecord(s *crud.Server, rec *crud.ServerRecord) error {
-	_, err := s.Delete(rec)
+// inTransaction runs fn within a single transaction which is rolled back in full if fn fails, so that no
+// partially registered upstream is ever left behind
+func (r *Registry) inTransaction(fn func(tx *sql.Tx) error) error {
+	ctx, cancel := r.withTimeout()
+	defer cancel()
+	tx, err := r.database.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	err = s.Commit()
-	if err != nil {
-		rbErr := s.Rollback()
-		r.logger.Sugar().Errorf("error during rollback %v", rbErr)
+	if err = fn(tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			r.logger.Sugar().Errorf("error during rollback %v", rbErr)
+		}
+		return err
 	}
-	return err
+	return tx.Commit()
 }
 
-func (r *Registry) deleteUpstreamRecord(u *crud.Upstream, rec *crud.UpstreamRecord) error {
-	_, err := u.Delete(rec)
-	if err != nil {
-		return err
-	}
-	err = u.Commit()
-	if err != nil {
-		rbErr := u.Rollback()
-		r.logger.Sugar().Errorf("error during rollback %v", rbErr)
-	}
-	return err
+// selectID returns the id of the first row matched by the query or sql.ErrNoRows
+func selectID(tx *sql.Tx, query string, args ...interface{}) (int64, error) {
+	var id int64
+	err := tx.QueryRow(query, args...).Scan(&id)
+	return id, err
 }
 
-func (r *Registry) deleteUpstreamUserMapRecord(u *crud.UserUpstreamMap, rec *crud.UserUpstreamMapRecord) error {
-	_, err := u.Delete(rec)
+// insert executes the insert statement and returns the id of the new row
+func insert(tx *sql.Tx, query string, args ...interface{}) (int64, error) {
+	res, err := tx.Exec(query, args...)
 	if err != nil {
-		return err
-	}
-	err = u.Commit()
-	if err != nil {
-		rbErr := u.Rollback()
-		r.logger.Sugar().Errorf("error during rollback %v", rbErr)
+		return 0, err
 	}
-	return err
+	return res.LastInsertId()
 }
 
-func (r *Registry) deletePrivateKeyRecord(u *crud.PrivateKeys, rec *crud.PrivateKeysRecord) error {
-	_, err := u.Delete(rec)
-	if err != nil {
-		return err
+// upsert looks a row up with the select statement, inserting it when missing and otherwise running the update
+// statement with the row id appended to the update arguments
+func upsert(tx *sql.Tx, selectQuery string, selectArgs []interface{}, insertQuery string, insertArgs []interface{}, updateQuery string, updateArgs []interface{}) (int64, error) {
+	id, err := selectID(tx, selectQuery, selectArgs...)
+	if err == sql.ErrNoRows {
+		return insert(tx, insertQuery, insertArgs...)
 	}
-	err = u.Commit()
 	if err != nil {
-		rbErr := u.Rollback()
-		r.logger.Sugar().Errorf("error during rollback %v", rbErr)
+		return 0, err
 	}
-	return err
-}
 
-func (r *Registry) deletePublicKeyRecords(u *crud.PublicKeys, rec []*crud.PublicKeysRecord) []error {
-	var errs []error
-	for _, record := range rec {
-		_, err := u.Delete(record)
-		if err != nil {
-			errs = append(errs, err)
-			continue
-		}
-		err = u.Commit()
-		if err != nil {
-			rbErr := u.Rollback()
-			r.logger.Sugar().Errorf("error during rollback %v", rbErr)
-			errs = append(errs, rbErr)
-			continue
-		}
-	}
-	return errs
-}
-
-func (r *Registry) deletePublicPrivateKeyMap(u *crud.PubkeyPrikeyMap, rec []*crud.PubkeyPrikeyMapRecord) []error {
-	var errs []error
-	for _, record := range rec {
-		_, err := u.Delete(record)
-		if err != nil {
-			errs = append(errs, err)
-			continue
-		}
-		err = u.Commit()
-		if err != nil {
-			rbErr := u.Rollback()
-			r.logger.Sugar().Errorf("error during rollback %v", rbErr)
-			errs = append(errs, rbErr)
-			continue
-		}
+	if _, err = tx.Exec(updateQuery, append(updateArgs, id)...); err != nil {
+		return 0, err
 	}
-	return errs
+	return id, nil
 }
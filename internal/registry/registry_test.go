@@ -3,10 +3,20 @@
 package registry
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
 	"database/sql"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"reflect"
 	"testing"
 
 	"go.uber.org/zap"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
 )
 
 const testName = "test"
@@ -80,11 +90,225 @@ func TestUnregister(t *testing.T) {
 	}
 }
 
+func TestRegisterUpdate(t *testing.T) {
+	r := beforeEach(t)
+	upstream := newTestFixture(t)
+	upstream.DownstreamPublicKey = []string{"kept", "removed"}
+
+	_, err := r.RegisterUpstream(upstream)
+	if err != nil {
+		t.Errorf("error registering upstream - %v", err)
+	}
+
+	updated := newTestFixture(t)
+	updated.Address = "127.0.0.2"
+	updated.SSHPiperPrivateKey = "rotated"
+	updated.DownstreamPublicKey = []string{"kept", "added"}
+
+	_, err = r.RegisterUpstream(updated)
+	if err != nil {
+		t.Errorf("error updating upstream - %v", err)
+	}
+
+	upstreams, err := r.ListUpstreams()
+	if err != nil {
+		t.Errorf("error listing upstreams - %v", err)
+	}
+	if len(upstreams) != 1 {
+		t.Fatalf("expected a single upstream - got %d", len(upstreams))
+	}
+	if !reflect.DeepEqual(upstreams[0], updated) {
+		t.Errorf("unexpected upstream, expected \n %v \n but got \n%v", updated, upstreams[0])
+	}
+}
+
+func TestRegisterDuplicateKeys(t *testing.T) {
+	r := beforeEach(t)
+	upstream := newTestFixture(t)
+	upstream.DownstreamPublicKey = []string{"example", "example"}
+
+	if _, err := r.RegisterUpstream(upstream); err != nil {
+		t.Errorf("error registering upstream - %v", err)
+	}
+	// a duplicate left by an earlier version of the registry
+	if _, err := r.database.Exec("insert into `public_keys` set `name` = ?, `data` = ?, `type` = '';", upstream.Name, "example"); err != nil {
+		t.Fatalf("error inserting duplicate key - %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.RegisterUpstream(upstream); err != nil {
+			t.Errorf("error registering upstream again - %v", err)
+		}
+	}
+
+	upstreams, err := r.ListUpstreams()
+	if err != nil {
+		t.Errorf("error listing upstreams - %v", err)
+	}
+	if len(upstreams) != 1 || !reflect.DeepEqual(upstreams[0].DownstreamPublicKey, []string{"example"}) {
+		t.Errorf("expected the key to be stored once - got %v", upstreams)
+	}
+}
+
+func TestRegisterUsernameTaken(t *testing.T) {
+	r := beforeEach(t)
+	upstream := newTestFixture(t)
+
+	_, err := r.RegisterUpstream(upstream)
+	if err != nil {
+		t.Errorf("error registering upstream - %v", err)
+	}
+
+	other := newTestFixture(t)
+	other.Name = "other"
+	other.Address = "127.0.0.2"
+	_, err = r.RegisterUpstream(other)
+	if err != ErrUsernameTaken {
+		t.Errorf("expected ErrUsernameTaken registering a duplicate username - got %v", err)
+	}
+}
+
+func TestUnregisterMissing(t *testing.T) {
+	r := beforeEach(t)
+	upstream := newTestFixture(t)
+
+	err := r.UnregisterUpstream(upstream)
+	if err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows when unregistering a missing upstream - got %v", err)
+	}
+}
+
+func TestListUpstreams(t *testing.T) {
+	r := beforeEach(t)
+	upstream := newTestFixture(t)
+
+	_, err := r.RegisterUpstream(upstream)
+	if err != nil {
+		t.Errorf("error registering upstream - %v", err)
+	}
+
+	upstreams, err := r.ListUpstreams()
+	if err != nil {
+		t.Errorf("error listing upstreams - %v", err)
+	}
+	if len(upstreams) != 1 {
+		t.Fatalf("expected a single upstream - got %d", len(upstreams))
+	}
+	if !reflect.DeepEqual(upstreams[0], upstream) {
+		t.Errorf("unexpected upstream, expected \n %v \n but got \n%v", upstream, upstreams[0])
+	}
+}
+
+func TestRegisterKeyTypes(t *testing.T) {
+	r := beforeEach(t)
+	upstream := newTestFixture(t)
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ecdsa key - %v", err)
+	}
+	der, err := x509.MarshalECPrivateKey(ecdsaKey)
+	if err != nil {
+		t.Fatalf("failed to marshal ecdsa key - %v", err)
+	}
+	upstream.SSHPiperPrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ed25519 key - %v", err)
+	}
+	publicKey, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatalf("failed to convert ed25519 key - %v", err)
+	}
+	upstream.DownstreamPublicKey = []string{base64.StdEncoding.EncodeToString(publicKey.Marshal())}
+
+	if _, err = r.RegisterUpstream(upstream); err != nil {
+		t.Errorf("error registering upstream - %v", err)
+	}
+
+	db, err := sql.Open("mysql", "root@tcp(127.0.0.1:3306)/sshpiper")
+	if err != nil {
+		t.Errorf("error creating raw connection to mysql - %v", err)
+	}
+	defer db.Close()
+
+	var keyType string
+	if err = db.QueryRow("SELECT type FROM private_keys LIMIT 1;").Scan(&keyType); err != nil {
+		t.Errorf("error when querying private_keys table - %v", err)
+	}
+	if keyType != ssh.KeyAlgoECDSA256 {
+		t.Errorf("unexpected private key type - got %v", keyType)
+	}
+	if err = db.QueryRow("SELECT type FROM public_keys LIMIT 1;").Scan(&keyType); err != nil {
+		t.Errorf("error when querying public_keys table - %v", err)
+	}
+	if keyType != ssh.KeyAlgoED25519 {
+		t.Errorf("unexpected public key type - got %v", keyType)
+	}
+}
+
+func TestUnregisterPartial(t *testing.T) {
+	r := beforeEach(t)
+	upstream := newTestFixture(t)
+
+	// a server row left behind without its upstream, as before registering became a single transaction
+	if _, err := r.database.Exec("insert into `server` set `name` = ?, `address` = ?;", upstream.Name, upstream.Address); err != nil {
+		t.Fatalf("error inserting server row - %v", err)
+	}
+
+	upstreams, err := r.ListUpstreams()
+	if err != nil {
+		t.Errorf("error listing upstreams - %v", err)
+	}
+	if len(upstreams) != 1 || upstreams[0].Name != upstream.Name || upstreams[0].Username != "" {
+		t.Errorf("expected the partial upstream to be listed without a username - got %v", upstreams)
+	}
+
+	if err = r.UnregisterUpstream(upstream); err != nil {
+		t.Errorf("error unregistering partial upstream - %v", err)
+	}
+
+	var count int
+	if err = r.database.QueryRow("select count(*) from `server`;").Scan(&count); err != nil {
+		t.Errorf("error when querying server table - %v", err)
+	}
+	if count != 0 {
+		t.Errorf("expected the server row to be deleted - got %d rows", count)
+	}
+}
+
+func TestMigrateSchema(t *testing.T) {
+	r := beforeEach(t)
+
+	// connecting migrated the schema already, migrating again is a no-op
+	if err := r.MigrateSchema(); err != nil {
+		t.Errorf("unexpected error migrating again - %v", err)
+	}
+	if err := r.CheckSchema(); err != nil {
+		t.Errorf("unexpected error checking the schema - %v", err)
+	}
+
+	future := SchemaVersion() + 1
+	if _, err := r.database.Exec("insert into "+schemaVersionTable+" (version, description) values (?, 'future');", future); err != nil {
+		t.Fatal(err)
+	}
+	defer r.database.Exec("delete from "+schemaVersionTable+" where version = ?;", future)
+
+	if err := r.MigrateSchema(); err == nil {
+		t.Errorf("expected migrating a newer schema to fail")
+	}
+	if err := r.CheckSchema(); err == nil {
+		t.Errorf("expected checking a newer schema to fail")
+	}
+}
+
 func newTestFixture(t *testing.T) *Upstream {
 	t.Helper()
 	return &Upstream{
 		Name:                testName,
 		Username:            "fixture",
+		UpstreamUsername:    "root",
 		Address:             testAddress,
 		SSHPiperPrivateKey:  "any",
 		DownstreamPublicKey: []string{"example"},
@@ -99,10 +323,52 @@ func beforeEach(t *testing.T) *Registry {
 	}
 
 	r := NewRegistry(logger)
-	err = r.ConnectDatabase()
+	err = r.ConnectDatabase(DefaultConfig())
 	if err != nil {
 		t.Errorf("error creating database connection %v", err)
 	}
 
+	err = truncateAll(r)
+	if err != nil {
+		t.Errorf("error truncating database %v", err)
+	}
+
 	return r
 }
+
+// truncateAll empties the sshpiper tables, leaving the schema version in place
+func truncateAll(r *Registry) error {
+	for _, table := range []string{
+		"pubkey_prikey_map",
+		"pubkey_upstream_map",
+		"user_upstream_map",
+		"private_keys",
+		"public_keys",
+		"server",
+		"upstream",
+	} {
+		if err := truncate(r, table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func truncate(r *Registry, table string) error {
+	tx, err := r.database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("set foreign_key_checks = 0;"); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(fmt.Sprintf("truncate table `%s`;", table)); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("set foreign_key_checks = 1;"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
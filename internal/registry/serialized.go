@@ -0,0 +1,48 @@
+package registry
+
+import "sync"
+
+// serialized runs one operation of the wrapped registry at a time
+type serialized struct {
+	mu sync.Mutex
+	r  Registrable
+}
+
+// Serialize operations on r. Registering is a read followed by writes, so concurrent registrations of one upstream,
+// such as from the secret and service handlers or from a handler and the reconciliation after winning an election,
+// could otherwise both insert it.
+func Serialize(r Registrable) Registrable {
+	return &serialized{r: r}
+}
+
+func (s *serialized) RegisterUpstream(upstream *Upstream) (*Upstream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.r.RegisterUpstream(upstream)
+}
+
+func (s *serialized) UnregisterUpstream(upstream *Upstream) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.r.UnregisterUpstream(upstream)
+}
+
+func (s *serialized) ListUpstreams() ([]*Upstream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.r.ListUpstreams()
+}
+
+// Ping is not serialized so that probes are answered while an operation is slow
+func (s *serialized) Ping() error {
+	return Ping(s.r)
+}
+
+// Close is not serialized so that it can roll back the operation in flight
+func (s *serialized) Close() error {
+	return Close(s.r)
+}
+
+func (s *serialized) VerifiesCertificates() bool {
+	return VerifiesCertificates(s.r)
+}
@@ -0,0 +1,302 @@
+package registry
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// Files of the sshpiper workingdir driver, one directory per downstream username
+const (
+	upstreamFile       = "sshpiper_upstream"
+	authorizedKeysFile = "authorized_keys"
+	privateKeyFile     = "id_rsa"
+	// nameFile records the upstream a directory belongs to, sshpiper ignores it
+	nameFile = "ksce_upstream_name"
+)
+
+// sshpiper refuses files which can be read by anyone but the owner
+const (
+	workingDirMode os.FileMode = 0700
+	fileMode       os.FileMode = 0600
+)
+
+// WorkingDir registers upstreams in the directory layout read by the sshpiper workingdir driver, on a volume
+// shared with the sshpiper pod. Directories without a name file were not created by the registry and are left alone,
+// their username is taken.
+type WorkingDir struct {
+	root   string
+	logger *zap.Logger
+	mu     sync.Mutex
+}
+
+func NewWorkingDir(root string, logger *zap.Logger) *WorkingDir {
+	return &WorkingDir{
+		root:   root,
+		logger: logger,
+	}
+}
+
+// Init creates the root directory when it does not exist yet
+func (w *WorkingDir) Init() error {
+	return os.MkdirAll(w.root, workingDirMode)
+}
+
+// Ping checks the shared volume is still mounted
+func (w *WorkingDir) Ping() error {
+	info, err := os.Stat(w.root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", w.root)
+	}
+	return nil
+}
+
+// RegisterUpstream writes the files of the upstream into the directory of its username. Each file is replaced
+// atomically, with sshpiper_upstream written last so that sshpiper never routes to a half written directory.
+func (w *WorkingDir) RegisterUpstream(upstream *Upstream) (*Upstream, error) {
+	if err := upstream.Validate(); err != nil {
+		return nil, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	dir := filepath.Join(w.root, upstream.Username)
+	owner, err := w.owner(dir)
+	switch {
+	case err == nil:
+		if owner != upstream.Name {
+			return nil, ErrUsernameTaken
+		}
+	case os.IsNotExist(err):
+		// a directory made by hand for sshpiper has no name file and must not be overwritten
+		if _, err = os.Stat(dir); err == nil {
+			return nil, ErrUsernameTaken
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err = w.create(dir, upstream.Name); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	// the upstream may have been registered under a different username before
+	previous, err := w.find(upstream.Name)
+	if err != nil {
+		return nil, err
+	}
+	if previous == dir {
+		previous = ""
+	}
+
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{privateKeyFile, []byte(upstream.SSHPiperPrivateKey)},
+		{authorizedKeysFile, authorizedKeys(upstream.DownstreamPublicKey)},
+		{upstreamFile, []byte(upstream.UpstreamUsername + "@" + upstream.Address + "\n")},
+	}
+	for _, f := range files {
+		if err = writeFileAtomic(filepath.Join(dir, f.name), f.data); err != nil {
+			return nil, err
+		}
+	}
+
+	if previous != "" {
+		if err = os.RemoveAll(previous); err != nil {
+			return nil, err
+		}
+	}
+
+	w.logger.Info("Upstream registered", zap.String("name", upstream.Name), zap.String("username", upstream.Username))
+	return upstream, nil
+}
+
+// UnregisterUpstream removes the directory of the upstream. sql.ErrNoRows is returned when there is none, as for
+// the MySQL registry, so that callers handle a missing upstream alike.
+func (w *WorkingDir) UnregisterUpstream(upstream *Upstream) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	dir, err := w.find(upstream.Name)
+	if err != nil {
+		return err
+	}
+	if dir == "" {
+		return sql.ErrNoRows
+	}
+	if err = os.RemoveAll(dir); err != nil {
+		return err
+	}
+	w.logger.Info("Upstream unregistered", zap.String("name", upstream.Name))
+	return nil
+}
+
+// ListUpstreams reads back every directory written by the registry
+func (w *WorkingDir) ListUpstreams() ([]*Upstream, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	entries, err := ioutil.ReadDir(w.root)
+	if err != nil {
+		return nil, err
+	}
+
+	var upstreams []*Upstream
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(w.root, entry.Name())
+		name, err := w.owner(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		u, err := readUpstream(dir, name, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, u)
+	}
+	return upstreams, nil
+}
+
+// create the directory with its name file in place, so that it is never found without one
+func (w *WorkingDir) create(dir, name string) error {
+	tmp, err := ioutil.TempDir(w.root, "."+filepath.Base(dir)+"-")
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp, workingDirMode); err == nil {
+		err = ioutil.WriteFile(filepath.Join(tmp, nameFile), []byte(name+"\n"), fileMode)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dir)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+	}
+	return err
+}
+
+// owner of the directory, an error satisfying os.IsNotExist is returned for directories not written by the registry
+func (w *WorkingDir) owner(dir string) (string, error) {
+	name, err := ioutil.ReadFile(filepath.Join(dir, nameFile))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(name)), nil
+}
+
+// find the directory of the upstream, empty when it is not registered
+func (w *WorkingDir) find(name string) (string, error) {
+	entries, err := ioutil.ReadDir(w.root)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(w.root, entry.Name())
+		if owner, err := w.owner(dir); err == nil && owner == name {
+			return dir, nil
+		}
+	}
+	return "", nil
+}
+
+func readUpstream(dir, name, username string) (*Upstream, error) {
+	target, err := ioutil.ReadFile(filepath.Join(dir, upstreamFile))
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := ioutil.ReadFile(filepath.Join(dir, privateKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	keys, err := ioutil.ReadFile(filepath.Join(dir, authorizedKeysFile))
+	if err != nil {
+		return nil, err
+	}
+
+	u := &Upstream{
+		Name:               name,
+		Username:           username,
+		SSHPiperPrivateKey: string(privateKey),
+	}
+	u.Address = strings.TrimSpace(string(target))
+	if i := strings.LastIndex(u.Address, "@"); i >= 0 {
+		u.UpstreamUsername = u.Address[:i]
+		u.Address = u.Address[i+1:]
+	}
+
+	for rest := keys; len(bytes.TrimSpace(rest)) > 0; {
+		var key ssh.PublicKey
+		key, _, _, rest, err = ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s in %s - %v", authorizedKeysFile, dir, err)
+		}
+		u.DownstreamPublicKey = append(u.DownstreamPublicKey, base64.StdEncoding.EncodeToString(key.Marshal()))
+	}
+	return u, nil
+}
+
+// authorizedKeys renders keys in the base64 wire format as an authorized_keys file
+func authorizedKeys(keys []string) []byte {
+	var b bytes.Buffer
+	for _, k := range keys {
+		raw, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			continue
+		}
+		key, err := ssh.ParsePublicKey(raw)
+		if err != nil {
+			continue
+		}
+		b.Write(ssh.MarshalAuthorizedKey(key))
+	}
+	return b.Bytes()
+}
+
+// writeFileAtomic replaces the file through a rename so that readers only ever see the old or the new content
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err = tmp.Chmod(fileMode); err == nil {
+		if _, err = tmp.Write(data); err == nil {
+			err = tmp.Sync()
+		}
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}